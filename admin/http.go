@@ -17,10 +17,12 @@ import (
 
 func SetupServer() *Server {
 	timeout, _ := time.ParseDuration("45s")
+	router := handler()
 	return &Server{
+		router: router,
 		svc: &http.Server{
 			Addr:         ":9090",
-			Handler:      handler(),
+			Handler:      router,
 			ReadTimeout:  timeout,
 			WriteTimeout: timeout,
 			IdleTimeout:  timeout,
@@ -31,13 +33,20 @@ func SetupServer() *Server {
 // Server represents a holder around a net/http Server which
 // is used for admin endpoints. (i.e. metrics, healthcheck)
 type Server struct {
-	svc *http.Server
+	router *mux.Router
+	svc    *http.Server
 }
 
 func (s *Server) BindAddress() string {
 	return s.svc.Addr
 }
 
+// AddHandler registers an HTTP handler on the admin service for the given
+// method and path. Only services which shouldn't be public belong here.
+func (s *Server) AddHandler(method, path string, h http.HandlerFunc) {
+	s.router.Methods(method).Path(path).HandlerFunc(h)
+}
+
 // Start brings up the admin HTTP service. This call blocks.
 func (s *Server) Listen() error {
 	if s == nil || s.svc == nil {
@@ -54,7 +63,7 @@ func (s *Server) Shutdown() {
 	s.svc.Shutdown(context.TODO())
 }
 
-func handler() http.Handler {
+func handler() *mux.Router {
 	r := mux.NewRouter()
 
 	// prometheus metrics
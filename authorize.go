@@ -0,0 +1,332 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+var (
+	// LoginURL is where users without a session are sent before authorizing a client.
+	// The authorization request is passed along as return_to.
+	// If empty BaseURL + "/login" is used.
+	LoginURL string = os.Getenv("LOGIN_URL")
+
+	// S256 code challenges are a base64url encoded SHA256 hash, verifiers are 43-128
+	// unreserved characters. See RFC 7636 section 4.1 and 4.2.
+	codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+	codeVerifierPattern  = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+)
+
+// authorizeHandler implements the authorization code grant (RFC 6749 section 4.1) for
+// users signed in with our cookie. Users without a session are sent to login first and
+// users who haven't authorized the client yet are asked for their consent.
+//
+// Public clients must use PKCE with the S256 method (RFC 7636).
+func (o *oauth) authorizeHandler(auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Until redirect_uri is checked we can't redirect errors back to the client.
+		req, err := o.server.ValidationAuthorizeRequest(r)
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		cli, err := o.manager.GetClient(req.ClientID)
+		if err != nil || cli == nil {
+			encodeError(w, errors.ErrInvalidClient)
+			return
+		}
+		if err := validateRedirectURI(cli.GetDomain(), req.RedirectURI); err != nil {
+			encodeError(w, err)
+			return
+		}
+
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		u, err := lookupSubject(userService, userId)
+		if err == errUserNotFound || (err == nil && !u.Verified) {
+			http.Redirect(w, r, loginRedirect(r), http.StatusFound)
+			return
+		}
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+
+		codeReq := &codeRequest{
+			challenge: r.FormValue("code_challenge"),
+			method:    r.FormValue("code_challenge_method"),
+			nonce:     r.FormValue("nonce"),
+		}
+		if err := checkCodeChallenge(cli, codeReq.challenge, codeReq.method); err != nil {
+			o.authorizeError(w, req, err)
+			return
+		}
+
+		if allowed, err := o.clientScopeHandler(cli.GetID(), req.Scope); err != nil || !allowed {
+			o.authorizeError(w, req, errors.ErrInvalidScope)
+			return
+		}
+		granted, err := o.checkGrant(cli, u, req.Scope)
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		if !granted {
+			renderConsent(w, r, cli, u, req.Scope)
+			return
+		}
+
+		req.UserID = u.ID
+		ti, err := o.server.GetAuthorizeToken(req)
+		if err != nil {
+			o.authorizeError(w, req, err)
+			return
+		}
+		if sess, err := findCurrentSession(r, auth, u.ID); err != nil {
+			internalError(w, err, "oauth")
+			return
+		} else if sess != nil {
+			codeReq.authTime = sess.CreatedAt
+		}
+		validUntil := ti.GetCodeCreateAt().Add(ti.GetCodeExpiresIn())
+		if err := o.tokenStore.recordCodeRequest(ti.GetCode(), codeReq, validUntil); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+
+		uri, err := o.server.GetRedirectURI(req, o.server.GetAuthorizeData(req.ResponseType, ti))
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		http.Redirect(w, r, uri, http.StatusFound)
+	}
+}
+
+// authorizeError sends err back to the client's (already validated) redirect_uri.
+func (o *oauth) authorizeError(w http.ResponseWriter, req *server.AuthorizeRequest, err error) {
+	data, _, _ := o.server.GetErrorData(err)
+	uri, err := o.server.GetRedirectURI(req, data)
+	if err != nil {
+		encodeError(w, err)
+		return
+	}
+	http.Redirect(w, req.Request, uri, http.StatusFound)
+}
+
+// loginRedirect returns the login page with r as return_to, so users come back to
+// authorize the client once they've logged in.
+func loginRedirect(r *http.Request) string {
+	login := LoginURL
+	if login == "" {
+		login = BaseURL + "/login"
+	}
+	u, err := url.Parse(login)
+	if err != nil {
+		return login
+	}
+	q := u.Query()
+	q.Set("return_to", BaseURL+r.URL.RequestURI())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// isPublicClient returns true for clients which can't keep a secret, like browser and
+// mobile apps. They're registered without a client secret.
+func isPublicClient(cli oauth2.ClientInfo) bool {
+	return cli.GetSecret() == ""
+}
+
+// clientAuthorizedHandler only lets public clients use the authorization code flow
+// (and refresh the tokens from it). Every other grant needs a client secret.
+func (o *oauth) clientAuthorizedHandler(clientId string, gt oauth2.GrantType) (bool, error) {
+	cli, err := o.manager.GetClient(clientId)
+	if err != nil {
+		return false, err
+	}
+	if isPublicClient(cli) {
+		return gt == oauth2.AuthorizationCode || gt == oauth2.Refreshing, nil
+	}
+	return true, nil
+}
+
+// clientInfoHandler authenticates the client of a token request from its form values.
+// Public clients leave out client_secret.
+//
+// The oauth2 library compares client_secret with the client's secret itself, but we
+// only store a hash of secrets. Once we've checked it (allowing a rotated secret's grace
+// period) the stored secret is handed back.
+func (o *oauth) clientInfoHandler(r *http.Request) (string, string, error) {
+	clientId := r.FormValue("client_id")
+	if clientId == "" {
+		return "", "", errors.ErrInvalidClient
+	}
+	cli, err := o.manager.GetClient(clientId)
+	if err != nil || cli == nil || !verifyClientSecret(cli, r.FormValue("client_secret")) {
+		return "", "", errors.ErrInvalidClient
+	}
+	return clientId, cli.GetSecret(), nil
+}
+
+// validateRedirectURI checks redirectURI against a client's registered redirect URIs,
+// which are kept space separated in the client's Domain. Only an exact match of a
+// registered URI which uses https (or http on the local machine) is allowed. Clients
+// registered with a bare domain (i.e. from /token/create) can't use redirects.
+func validateRedirectURI(registered, redirectURI string) error {
+	if checkRedirectURI(redirectURI) != nil {
+		return errors.ErrInvalidRedirectURI
+	}
+	for _, uri := range strings.Fields(registered) {
+		if uri == redirectURI {
+			return nil
+		}
+	}
+	return errors.ErrInvalidRedirectURI
+}
+
+// checkRedirectURI validates a redirect URI for a client. They need to be absolute
+// and use https unless they're on the local machine.
+func checkRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" || strings.ContainsAny(uri, " \t\r\n") {
+		return fmt.Errorf("invalid redirect URI %q", uri)
+	}
+	switch {
+	case u.Scheme == "https":
+		return nil
+	case u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1" || u.Hostname() == "::1"):
+		return nil
+	}
+	return fmt.Errorf("redirect URI %q must use https", uri)
+}
+
+// checkCodeChallenge validates the PKCE parameters of an authorization request. Only
+// S256 is supported as "plain" offers no protection if the request is intercepted.
+func checkCodeChallenge(cli oauth2.ClientInfo, challenge, method string) error {
+	if challenge == "" {
+		if isPublicClient(cli) {
+			return errors.ErrInvalidRequest
+		}
+		return nil
+	}
+	if method != "S256" || !codeChallengePattern.MatchString(challenge) {
+		return errors.ErrInvalidRequest
+	}
+	return nil
+}
+
+// codeRequest holds the parts of an authorization request which are needed again when
+// its code is exchanged: the PKCE challenge, and the OpenID Connect nonce and time the
+// user logged in for the id_token.
+type codeRequest struct {
+	challenge string
+	method    string
+	nonce     string
+	authTime  time.Time
+}
+
+// checkCodeVerifier checks the code_verifier of an authorization_code grant against the
+// challenge sent to /authorize. The code is burned if verification fails. The code's
+// authorization request is returned.
+func (o *oauth) checkCodeVerifier(tgr *oauth2.TokenGenerateRequest, verifier string) (*codeRequest, error) {
+	cli, err := o.manager.GetClient(tgr.ClientID)
+	if err != nil {
+		return nil, errors.ErrInvalidClient
+	}
+	codeReq, err := o.tokenStore.findCodeRequest(tgr.Code)
+	if err != nil {
+		return nil, err
+	}
+	if codeReq.challenge == "" {
+		if isPublicClient(cli) || verifier != "" {
+			return nil, errors.ErrInvalidGrant
+		}
+		return codeReq, nil
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	if !codeVerifierPattern.MatchString(verifier) || subtle.ConstantTimeCompare([]byte(computed), []byte(codeReq.challenge)) != 1 {
+		if err := o.tokenStore.RemoveByCode(tgr.Code); err != nil {
+			o.logger.Log("oauth", fmt.Sprintf("problem removing code for clientId=%s: %v", tgr.ClientID, err))
+		}
+		return nil, errors.ErrInvalidGrant
+	}
+	return codeReq, nil
+}
+
+// recordCodeRequest saves the authorization request for code until the code expires.
+func (s *tokenFamilyStore) recordCodeRequest(code string, req *codeRequest, validUntil time.Time) error {
+	code, err := hash(code)
+	if err != nil {
+		return err
+	}
+	var authTime string
+	if !req.authTime.IsZero() {
+		authTime = req.authTime.Format(serializedTimestampFormat)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`delete from oauth2_code_challenges where valid_until < ?`, time.Now().Format(serializedTimestampFormat))
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem cleaning up code challenges, err=%v, rollback err=%v", err, e)
+	}
+	query := `insert into oauth2_code_challenges (code, code_challenge, code_challenge_method, nonce, auth_time, valid_until) values (?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(query, code, req.challenge, req.method, req.nonce, authTime, validUntil.Format(serializedTimestampFormat))
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem recording code challenge, err=%v, rollback err=%v", err, e)
+	}
+	return tx.Commit()
+}
+
+// findCodeRequest returns the authorization request for code. Its challenge is empty if
+// the request didn't include one.
+//
+// Requests are kept until their code expires (rather than removed when read) so a
+// failed or replayed exchange can't strip PKCE from a code.
+func (s *tokenFamilyStore) findCodeRequest(code string) (*codeRequest, error) {
+	code, err := hash(code)
+	if err != nil {
+		return nil, err
+	}
+	query := `select code_challenge, code_challenge_method, coalesce(nonce, ''), coalesce(auth_time, '') from oauth2_code_challenges where code = ? limit 1`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var req codeRequest
+	var authTime string
+	if err := stmt.QueryRow(code).Scan(&req.challenge, &req.method, &req.nonce, &authTime); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	// sessions copied from user_cookies don't know when the user logged in
+	req.authTime, _ = time.Parse(serializedTimestampFormat, authTime)
+	return &req, nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestAuthorize__validateRedirectURI(t *testing.T) {
+	cases := []struct {
+		registered, redirect string
+		valid                bool
+	}{
+		{"https://app.moov.io/callback", "https://app.moov.io/callback", true},
+		{"https://a.moov.io/cb https://b.moov.io/cb", "https://b.moov.io/cb", true},
+		{"https://app.moov.io/callback", "https://app.moov.io/callback/other", false},
+		{"https://app.moov.io/callback", "https://app.moov.io/callback?next=evil", false},
+		{"https://app.moov.io/callback", "https://app.moov.io/callback#frag", false},
+		{"http://localhost:8080/callback", "http://localhost:8080/callback", true},
+		{"http://127.0.0.1/callback", "http://127.0.0.1/callback", true},
+		{"http://[::1]:8080/callback", "http://[::1]:8080/callback", true},
+		{"http://app.moov.io/callback", "http://app.moov.io/callback", false},
+		{"https://app.moov.io/callback", "http://app.moov.io/callback", false},
+		{"localhost", "http://localhost:8080/callback", false},
+		{"moov.io", "https://moov.io/callback", false},
+		{"moov.io", "https://moov.io.evil.com/callback", false},
+		{"moov.io", "javascript://moov.io/alert(1)", false},
+		{"moov.io", "/callback", false},
+		{"", "https://moov.io/callback", false},
+	}
+	for i := range cases {
+		err := validateRedirectURI(cases[i].registered, cases[i].redirect)
+		if cases[i].valid != (err == nil) {
+			t.Errorf("registered=%q redirect=%q err=%v", cases[i].registered, cases[i].redirect, err)
+		}
+	}
+}
+
+func codeVerifier() (string, string) {
+	verifier := generateID() + generateID()
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestAuthorize__codeFlow(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+
+	u := &User{ID: generateID(), Email: "test@moov.io", Verified: true, CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// public client, no secret
+	redirectURI := "https://app.moov.io/callback"
+	if err := o.clientStore.Set("public", &models.Client{ID: "public", Domain: redirectURI, UserID: u.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func(params url.Values, withCookie bool) *url.URL {
+		r := httptest.NewRequest("GET", "/authorize?"+params.Encode(), nil)
+		if withCookie {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		o.authorizeHandler(authService, userService)(w, r)
+		w.Flush()
+		if w.Code != http.StatusFound {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc
+	}
+
+	verifier, challenge := codeVerifier()
+	params := url.Values{
+		"response_type":         []string{"code"},
+		"client_id":             []string{"public"},
+		"redirect_uri":          []string{redirectURI},
+		"state":                 []string{"xyz"},
+		"code_challenge":        []string{challenge},
+		"code_challenge_method": []string{"S256"},
+	}
+
+	// users without a session login first
+	loc := authorize(params, false)
+	if !strings.HasPrefix(loc.String(), BaseURL+"/login") || !strings.Contains(loc.Query().Get("return_to"), "/authorize?") {
+		t.Errorf("got %s", loc)
+	}
+
+	// public clients need PKCE
+	withoutPKCE := url.Values{}
+	for k, v := range params {
+		if !strings.HasPrefix(k, "code_challenge") {
+			withoutPKCE[k] = v
+		}
+	}
+	loc = authorize(withoutPKCE, true)
+	if loc.Query().Get("error") != "invalid_request" || loc.Query().Get("state") != "xyz" {
+		t.Errorf("got %s", loc)
+	}
+
+	loc = authorize(params, true)
+	code := loc.Query().Get("code")
+	if !strings.HasPrefix(loc.String(), redirectURI) || code == "" || loc.Query().Get("state") != "xyz" {
+		t.Fatalf("got %s", loc)
+	}
+
+	exchange := url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"client_id":     []string{"public"},
+		"code":          []string{code},
+		"redirect_uri":  []string{redirectURI},
+		"code_verifier": []string{verifier},
+	}
+
+	// public clients can't use other grants
+	if code, resp := requestToken(t, o, url.Values{"grant_type": []string{"client_credentials"}, "client_id": []string{"public"}}); code == http.StatusOK {
+		t.Errorf("got %d: %#v", code, resp)
+	}
+
+	statusCode, tok := requestToken(t, o, exchange)
+	if statusCode != http.StatusOK || tok.AccessToken == "" || tok.RefreshToken == "" {
+		t.Fatalf("got %d: %#v", statusCode, tok)
+	}
+	ti, err := o.manager.LoadAccessToken(tok.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.GetUserID() != u.ID || ti.GetClientID() != "public" {
+		t.Errorf("userId=%s clientId=%s", ti.GetUserID(), ti.GetClientID())
+	}
+
+	// codes are single use
+	if statusCode, resp := requestToken(t, o, exchange); statusCode == http.StatusOK {
+		t.Errorf("got %d: %#v", statusCode, resp)
+	}
+
+	// a wrong verifier burns the code
+	loc = authorize(params, true)
+	exchange.Set("code", loc.Query().Get("code"))
+	exchange.Set("code_verifier", strings.Repeat("a", 43))
+	if statusCode, resp := requestToken(t, o, exchange); statusCode == http.StatusOK || resp.Error != "invalid_grant" {
+		t.Errorf("got %d: %#v", statusCode, resp)
+	}
+	exchange.Set("code_verifier", verifier)
+	if statusCode, resp := requestToken(t, o, exchange); statusCode == http.StatusOK {
+		t.Errorf("got %d: %#v", statusCode, resp)
+	}
+}
+
+func TestAuthorize__invalidRequests(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+
+	cases := []url.Values{
+		// unknown client
+		{"response_type": []string{"code"}, "client_id": []string{"other"}, "redirect_uri": []string{"http://localhost/cb"}},
+		// unregistered redirect_uri
+		{"response_type": []string{"code"}, "client_id": []string{"client"}, "redirect_uri": []string{"https://evil.com/cb"}},
+		// missing redirect_uri
+		{"response_type": []string{"code"}, "client_id": []string{"client"}},
+	}
+	for i := range cases {
+		r := httptest.NewRequest("GET", "/authorize?"+cases[i].Encode(), nil)
+		w := httptest.NewRecorder()
+		o.authorizeHandler(authService, userService)(w, r)
+		w.Flush()
+		if w.Code != http.StatusBadRequest || w.Header().Get("Location") != "" {
+			t.Errorf("%v: got %d", cases[i], w.Code)
+		}
+	}
+}
+
+func TestAuthorize__checkCodeChallenge(t *testing.T) {
+	_, challenge := codeVerifier()
+	confidential := &models.Client{ID: "client", Secret: "secret"}
+	public := &models.Client{ID: "public"}
+
+	if err := checkCodeChallenge(confidential, "", ""); err != nil {
+		t.Errorf("confidential clients can skip PKCE: %v", err)
+	}
+	if err := checkCodeChallenge(public, "", ""); err == nil {
+		t.Error("public clients need PKCE")
+	}
+	if err := checkCodeChallenge(public, challenge, "S256"); err != nil {
+		t.Error(err)
+	}
+	if err := checkCodeChallenge(public, challenge, "plain"); err == nil {
+		t.Error("plain isn't supported")
+	}
+	if err := checkCodeChallenge(public, "short", "S256"); err == nil {
+		t.Error("expected error")
+	}
+}
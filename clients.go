@@ -0,0 +1,362 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moov-io/auth/pkg/oauthclient"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+const (
+	maxClientNameLength = 100
+
+	// defaultClientSecretGracePeriod is how long the old secret of a rotated client keeps working.
+	defaultClientSecretGracePeriod = 24 * time.Hour
+)
+
+// clientRequest is the body of POST /oauth2/clients
+type clientRequest struct {
+	Name         string   `json:"name"`
+	Scopes       []string `json:"scopes"`
+	RedirectURIs []string `json:"redirectUris"`
+
+	// Public clients (browser and mobile apps) have no secret and must use PKCE.
+	Public bool `json:"public"`
+}
+
+func (req *clientRequest) validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxClientNameLength {
+		return fmt.Errorf("name is required and can be up to %d characters", maxClientNameLength)
+	}
+	for _, s := range req.Scopes {
+		if s == "" || strings.ContainsAny(s, " \t\r\n\"\\") {
+			return fmt.Errorf("invalid scope %q", s)
+		}
+	}
+	for _, uri := range req.RedirectURIs {
+		if err := checkRedirectURI(uri); err != nil {
+			return err
+		}
+	}
+	if req.Public && len(req.RedirectURIs) == 0 {
+		return errors.New("public clients need a redirect URI")
+	}
+	return nil
+}
+
+// clientResponse is how clients are rendered back to their owner. Secret is only
+// included when it's created.
+type clientResponse struct {
+	ID           string    `json:"id"`
+	Secret       string    `json:"secret,omitempty"`
+	Name         string    `json:"name"`
+	Scopes       []string  `json:"scopes"`
+	RedirectURIs []string  `json:"redirectUris"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"createdAt"`
+
+	// PreviousSecretExpiresAt is when the secret replaced by the last rotation
+	// stops working, it's only set while the old secret is still valid.
+	PreviousSecretExpiresAt *time.Time `json:"previousSecretExpiresAt,omitempty"`
+}
+
+func newClientResponse(cli *oauthclient.Client, withSecret bool) *clientResponse {
+	resp := &clientResponse{
+		ID:           cli.GetID(),
+		Name:         cli.Name,
+		Scopes:       strings.Fields(cli.Scope),
+		RedirectURIs: strings.Fields(cli.GetDomain()),
+		Public:       isPublicClient(cli),
+		CreatedAt:    cli.CreatedAt,
+	}
+	if withSecret {
+		resp.Secret = cli.GetSecret()
+	}
+	if cli.PreviousSecret != "" && time.Now().Before(cli.PreviousSecretExpiresAt) {
+		resp.PreviousSecretExpiresAt = &cli.PreviousSecretExpiresAt
+	}
+	return resp
+}
+
+// verifyClientSecret checks secret against the secret of cli. A client's previous
+// secret is accepted until its grace period ends.
+func verifyClientSecret(cli oauth2.ClientInfo, secret string) bool {
+	if c, ok := cli.(*oauthclient.Client); ok {
+		return c.VerifySecret(secret)
+	}
+	return subtle.ConstantTimeCompare([]byte(cli.GetSecret()), []byte(secret)) == 1
+}
+
+// clientName returns the name to show users for cli, falling back to its ID.
+func clientName(cli oauth2.ClientInfo) string {
+	if c, ok := cli.(*oauthclient.Client); ok && c.Name != "" {
+		return c.Name
+	}
+	return cli.GetID()
+}
+
+// isLegacyClient returns true for clients from /token/create, which predate named
+// clients and are replaced whenever a user recreates their token.
+func isLegacyClient(cli oauth2.ClientInfo) bool {
+	c, ok := cli.(*oauthclient.Client)
+	return !ok || c.Name == ""
+}
+
+// clientScopeHandler only lets clients request the scopes they were registered with.
+func (o *oauth) clientScopeHandler(clientId, scope string) (bool, error) {
+	cli, err := o.manager.GetClient(clientId)
+	if err != nil {
+		return false, err
+	}
+	if c, ok := cli.(*oauthclient.Client); ok && c.GetScope() != "" {
+		return scopesCover(c.GetScope(), scope), nil
+	}
+	return true, nil
+}
+
+// findVerifiedUserId returns the userId from our cookie on r. An empty userId is returned
+// if there's no session or the user hasn't verified their email address.
+func findVerifiedUserId(r *http.Request, auth authable, userService userRepository) (string, error) {
+	userId, err := findUserIdFromCookie(r, auth)
+	if err != nil || userId == "" {
+		return "", err
+	}
+	u, err := lookupSubject(userService, userId)
+	if err == errUserNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !u.Verified {
+		return "", nil
+	}
+	return u.ID, nil
+}
+
+// findUserClient returns the client with id if it's owned by userId, otherwise nil.
+func (o *oauth) findUserClient(userId string, id string) (*oauthclient.Client, error) {
+	cli, err := o.clientStore.GetByID(id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	c, ok := cli.(*oauthclient.Client)
+	if !ok || c.GetUserID() != userId {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// createClientHandler registers a new oauth client for the user. The client secret is
+// only returned here (and when rotated).
+func (o *oauth) createClientHandler(auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findVerifiedUserId(r, auth, userService)
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		var req clientRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			encodeError(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			encodeError(w, err)
+			return
+		}
+
+		cli := &oauthclient.Client{
+			Client: models.Client{
+				ID:     generateID()[:12],
+				Domain: strings.Join(req.RedirectURIs, " "),
+				UserID: userId,
+			},
+			Name:      req.Name,
+			Scope:     strings.Join(req.Scopes, " "),
+			CreatedAt: time.Now(),
+		}
+		if !req.Public {
+			cli.Secret = generateID()
+		}
+		if err := o.clientStore.Set(cli.GetID(), cli); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		tokenGenerations.With("method", "oauth2_via_web").Add(1)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(newClientResponse(cli, true)); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+	}
+}
+
+func (o *oauth) listClientsHandler(auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findVerifiedUserId(r, auth, userService)
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		records, err := o.clientStore.GetByUserID(userId)
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			internalError(w, err, "oauth")
+			return
+		}
+		clients := make([]*clientResponse, 0, len(records))
+		for i := range records {
+			if c, ok := records[i].(*oauthclient.Client); ok {
+				clients = append(clients, newClientResponse(c, false))
+			}
+		}
+
+		type response struct {
+			Clients []*clientResponse `json:"clients"`
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(&response{clients}); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+	}
+}
+
+func (o *oauth) deleteClientHandler(auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findVerifiedUserId(r, auth, userService)
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		cli, err := o.findUserClient(userId, mux.Vars(r)["id"])
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		if cli == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := o.clientStore.DeleteByID(cli.GetID()); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		if _, err := o.tokens.removeByClient(cli.GetID()); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		authInactivations.With("method", "oauth2").Add(1)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// rotateClientHandler replaces the client's secret, the new secret is returned. The old
+// secret keeps working for clientSecretGracePeriod, or a shorter gracePeriod (i.e. "0s"
+// for a leaked secret) from the request body.
+func (o *oauth) rotateClientHandler(auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findVerifiedUserId(r, auth, userService)
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		cli, err := o.findUserClient(userId, mux.Vars(r)["id"])
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		if cli == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if isPublicClient(cli) {
+			encodeError(w, errors.New("public clients don't have a secret"))
+			return
+		}
+
+		gracePeriod, err := readGracePeriod(r, o.clientSecretGracePeriod)
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		cli.RotateSecret(generateID(), time.Now().Add(gracePeriod))
+		if err := o.clientStore.Set(cli.GetID(), cli); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		tokenGenerations.With("method", "oauth2_via_web").Add(1)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(newClientResponse(cli, true)); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+	}
+}
+
+// readGracePeriod reads the optional gracePeriod from a rotate request. It can only
+// shorten max.
+func readGracePeriod(r *http.Request, max time.Duration) (time.Duration, error) {
+	bs, err := read(r.Body)
+	if err != nil || len(bs) == 0 {
+		return max, err
+	}
+	var req struct {
+		GracePeriod string `json:"gracePeriod"`
+	}
+	if err := json.Unmarshal(bs, &req); err != nil {
+		return 0, err
+	}
+	if req.GracePeriod == "" {
+		return max, nil
+	}
+	d, err := time.ParseDuration(req.GracePeriod)
+	if err != nil || d < 0 || d > max {
+		return 0, fmt.Errorf("gracePeriod must be a duration between 0s and %v", max)
+	}
+	return d, nil
+}
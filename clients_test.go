@@ -0,0 +1,223 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/auth/pkg/oauthclient"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestClients__validate(t *testing.T) {
+	cases := []struct {
+		req   clientRequest
+		valid bool
+	}{
+		{clientRequest{Name: "app"}, true},
+		{clientRequest{Name: "app", Scopes: []string{"read"}, RedirectURIs: []string{"https://moov.io/cb", "http://localhost:8080/cb"}}, true},
+		{clientRequest{Name: "app", Public: true, RedirectURIs: []string{"https://moov.io/cb"}}, true},
+		{clientRequest{Name: " "}, false},
+		{clientRequest{Name: strings.Repeat("a", maxClientNameLength+1)}, false},
+		{clientRequest{Name: "app", Scopes: []string{"read write"}}, false},
+		{clientRequest{Name: "app", RedirectURIs: []string{"http://moov.io/cb"}}, false},
+		{clientRequest{Name: "app", RedirectURIs: []string{"https://moov.io/cb#frag"}}, false},
+		{clientRequest{Name: "app", RedirectURIs: []string{"/cb"}}, false},
+		{clientRequest{Name: "app", Public: true}, false},
+	}
+	for i := range cases {
+		err := cases[i].req.validate()
+		if cases[i].valid != (err == nil) {
+			t.Errorf("%#v: err=%v", cases[i].req, err)
+		}
+	}
+}
+
+func TestClients__routes(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+
+	u := &User{ID: generateID(), Email: "test@moov.io", Verified: true, CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addOAuthRoutes(router, o, log.NewNopLogger(), authService, userService)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) *clientResponse {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var resp clientResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return &resp
+	}
+	clientCredentials := func(id, secret, scope string) int {
+		code, _ := requestToken(t, o, url.Values{
+			"grant_type":    []string{"client_credentials"},
+			"client_id":     []string{id},
+			"client_secret": []string{secret},
+			"scope":         []string{scope},
+		})
+		return code
+	}
+
+	// create two clients
+	first := decode(serve("POST", "/oauth2/clients", `{"name": "billing", "scopes": ["read"], "redirectUris": ["https://billing.moov.io/cb"]}`))
+	if first.ID == "" || first.Secret == "" || first.Name != "billing" || first.Public {
+		t.Errorf("%#v", first)
+	}
+	second := decode(serve("POST", "/oauth2/clients", `{"name": "payroll"}`))
+	if w := serve("POST", "/oauth2/clients", `{"name": ""}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// clients are limited to their scopes
+	if code := clientCredentials(first.ID, first.Secret, "read"); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if code := clientCredentials(first.ID, first.Secret, "read write"); code == http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+
+	// list without secrets
+	w := serve("GET", "/oauth2/clients", "")
+	var list struct {
+		Clients []*clientResponse `json:"clients"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Clients) != 2 {
+		t.Fatalf("%#v", list.Clients)
+	}
+	for _, c := range list.Clients {
+		if c.Secret != "" {
+			t.Errorf("secret returned: %#v", c)
+		}
+	}
+
+	// rotating one client leaves the other alone
+	rotated := decode(serve("POST", "/oauth2/clients/"+first.ID+"/rotate", ""))
+	if rotated.Secret == "" || rotated.Secret == first.Secret || rotated.Name != "billing" {
+		t.Errorf("%#v", rotated)
+	}
+	if rotated.PreviousSecretExpiresAt == nil || rotated.PreviousSecretExpiresAt.Before(time.Now().Add(defaultClientSecretGracePeriod-time.Minute)) {
+		t.Errorf("previousSecretExpiresAt=%v", rotated.PreviousSecretExpiresAt)
+	}
+	for _, secret := range []string{first.Secret, rotated.Secret} {
+		if code := clientCredentials(first.ID, secret, "read"); code != http.StatusOK {
+			t.Errorf("got %d", code)
+		}
+	}
+
+	// rotating without a grace period stops the old secret immediately
+	if w := serve("POST", "/oauth2/clients/"+first.ID+"/rotate", `{"gracePeriod": "1000h"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	leaked := rotated
+	rotated = decode(serve("POST", "/oauth2/clients/"+first.ID+"/rotate", `{"gracePeriod": "0s"}`))
+	if rotated.PreviousSecretExpiresAt != nil {
+		t.Errorf("previousSecretExpiresAt=%v", rotated.PreviousSecretExpiresAt)
+	}
+	for _, secret := range []string{first.Secret, leaked.Secret} {
+		if code := clientCredentials(first.ID, secret, "read"); code == http.StatusOK {
+			t.Errorf("old secret still works, got %d", code)
+		}
+	}
+	if code := clientCredentials(first.ID, rotated.Secret, "read"); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if code := clientCredentials(second.ID, second.Secret, ""); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+
+	// /token/create only replaces unnamed clients, even when a name matches its ID
+	sameName := &oauthclient.Client{Client: models.Client{ID: "reports", Secret: "secret", UserID: u.ID}, Name: "reports"}
+	if err := o.clientStore.Set(sameName.ID, sameName); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve("POST", "/token/create", ""); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if code := clientCredentials(second.ID, second.Secret, ""); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if code := clientCredentials("reports", "secret", ""); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+
+	// public clients have nothing to rotate
+	public := decode(serve("POST", "/oauth2/clients", `{"name": "mobile", "public": true, "redirectUris": ["https://app.moov.io/cb"]}`))
+	if public.Secret != "" || !public.Public {
+		t.Errorf("%#v", public)
+	}
+	if w := serve("POST", "/oauth2/clients/"+public.ID+"/rotate", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// other users' clients are hidden
+	other := &User{ID: generateID(), Email: "other@moov.io", Verified: true, CreatedAt: time.Now()}
+	if err := userService.upsert(other); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err = createCookie(other.ID, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve("DELETE", "/oauth2/clients/"+first.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := serve("POST", "/oauth2/clients/"+first.ID+"/rotate", ""); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// delete
+	cookie, _ = createCookie(u.ID, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if w := serve("DELETE", "/oauth2/clients/"+first.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if code := clientCredentials(first.ID, rotated.Secret, "read"); code == http.StatusOK {
+		t.Errorf("deleted client got %d", code)
+	}
+
+	// users need a session
+	cookie.Value = "invalid"
+	if w := serve("GET", "/oauth2/clients", ""); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+}
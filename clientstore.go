@@ -0,0 +1,232 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/moov-io/auth/pkg/buntdbclient"
+	"github.com/moov-io/auth/pkg/oauthclient"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// clientStore holds our oauth clients. Clients are returned as *oauthclient.Client
+// with their secrets hashed.
+//
+// Lookups of missing clients return an error containing "not found", GetByUserID
+// returns nil instead.
+type clientStore interface {
+	oauth2.ClientStore
+
+	Set(id string, cli oauth2.ClientInfo) error
+	GetByUserID(userId string) ([]oauth2.ClientInfo, error)
+	DeleteByID(id string) error
+	Close() error
+}
+
+// setupClientStore returns the client store chosen with OAUTH2_CLIENTS_STORE, either
+// "buntdb" (the default, at OAUTH2_CLIENTS_DB_PATH) or "sql" (in db, which is also
+// accepted as "sqlite").
+func setupClientStore(logger log.Logger, db *sql.DB) (clientStore, error) {
+	switch v := strings.ToLower(os.Getenv("OAUTH2_CLIENTS_STORE")); v {
+	case "", "buntdb":
+		return openBuntClientStore()
+	case "sql", "sqlite":
+		return &sqliteClientStore{db, logger}, nil
+	default:
+		return nil, fmt.Errorf("unknown OAUTH2_CLIENTS_STORE %q", v)
+	}
+}
+
+func openBuntClientStore() (*buntdbclient.ClientStore, error) {
+	path := os.Getenv("OAUTH2_CLIENTS_DB_PATH")
+	if path == "" {
+		path = "oauth2_clients.db"
+	}
+	cs, err := buntdbclient.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem creating clients store: %v", err)
+	}
+	return cs, nil
+}
+
+type sqliteClientStore struct {
+	db  *sql.DB
+	log log.Logger
+}
+
+const clientColumns = `id, secret, domain, user_id, name, scope, previous_secret, previous_secret_expires_at, created_at, updated_at`
+
+func (s *sqliteClientStore) GetByID(id string) (oauth2.ClientInfo, error) {
+	stmt, err := s.db.Prepare(`select ` + clientColumns + ` from oauth2_clients where id = ? limit 1`)
+	if err != nil {
+		return &oauthclient.Client{}, err
+	}
+	defer stmt.Close()
+
+	cli, err := scanClient(stmt.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return &oauthclient.Client{}, fmt.Errorf("problem reading %s: not found", id)
+	}
+	if err != nil {
+		return &oauthclient.Client{}, fmt.Errorf("problem reading %s: %v", id, err)
+	}
+	return cli, nil
+}
+
+// Set writes cli, replacing any client with the same id. Secrets are hashed before
+// they're written, cli isn't modified.
+func (s *sqliteClientStore) Set(id string, cli oauth2.ClientInfo) error {
+	if inc := cli.GetID(); id != inc {
+		return fmt.Errorf("sqliteClientStore: id's don't match, id=%s and cli=%s", id, inc)
+	}
+
+	c, ok := cli.(*oauthclient.Client)
+	if !ok {
+		c = &oauthclient.Client{
+			Client: models.Client{
+				ID:     cli.GetID(),
+				Secret: cli.GetSecret(),
+				Domain: cli.GetDomain(),
+				UserID: cli.GetUserID(),
+			},
+		}
+	}
+	secret, err := oauthclient.HashSecret(c.GetSecret())
+	if err != nil {
+		return fmt.Errorf("problem hashing secret for %s: %v", id, err)
+	}
+	previousSecret, err := oauthclient.HashSecret(c.PreviousSecret)
+	if err != nil {
+		return fmt.Errorf("problem hashing previous secret for %s: %v", id, err)
+	}
+	createdAt := c.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	query := `insert into oauth2_clients (` + clientColumns + `) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+on conflict (id) do update set secret = excluded.secret, domain = excluded.domain, user_id = excluded.user_id, name = excluded.name, scope = excluded.scope,
+previous_secret = excluded.previous_secret, previous_secret_expires_at = excluded.previous_secret_expires_at, created_at = excluded.created_at, updated_at = excluded.updated_at`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(id, secret, c.GetDomain(), c.GetUserID(), c.Name, c.Scope, previousSecret,
+		c.PreviousSecretExpiresAt.Format(serializedTimestampFormat), createdAt.Format(serializedTimestampFormat), time.Now().Format(serializedTimestampFormat))
+	if err != nil {
+		return fmt.Errorf("problem updating %s: %v", id, err)
+	}
+	return nil
+}
+
+// GetByUserID returns the clients owned by userId, or nil if there are none.
+func (s *sqliteClientStore) GetByUserID(userId string) ([]oauth2.ClientInfo, error) {
+	return s.list(`where user_id = ?`, userId)
+}
+
+// List returns every client.
+func (s *sqliteClientStore) List() ([]oauth2.ClientInfo, error) {
+	return s.list(``)
+}
+
+func (s *sqliteClientStore) list(where string, args ...interface{}) ([]oauth2.ClientInfo, error) {
+	stmt, err := s.db.Prepare(`select ` + clientColumns + ` from oauth2_clients ` + where + ` order by created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []oauth2.ClientInfo
+	for rows.Next() {
+		cli, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, cli)
+	}
+	return clients, rows.Err()
+}
+
+func (s *sqliteClientStore) DeleteByID(id string) error {
+	stmt, err := s.db.Prepare(`delete from oauth2_clients where id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("problem deleting %s: not found", id)
+	}
+	return nil
+}
+
+// Close is a no-op, the database is shared and closed by main.
+func (s *sqliteClientStore) Close() error {
+	return nil
+}
+
+func scanClient(row interface{ Scan(...interface{}) error }) (*oauthclient.Client, error) {
+	var cli oauthclient.Client
+	var previousSecretExpiresAt, createdAt, updatedAt string
+	err := row.Scan(&cli.ID, &cli.Secret, &cli.Domain, &cli.UserID, &cli.Name, &cli.Scope, &cli.PreviousSecret, &previousSecretExpiresAt, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if cli.PreviousSecretExpiresAt, err = time.Parse(serializedTimestampFormat, previousSecretExpiresAt); err != nil {
+		return nil, err
+	}
+	if cli.CreatedAt, err = time.Parse(serializedTimestampFormat, createdAt); err != nil {
+		return nil, err
+	}
+	if cli.UpdatedAt, err = time.Parse(serializedTimestampFormat, updatedAt); err != nil {
+		return nil, err
+	}
+	return &cli, nil
+}
+
+// migrateClients copies every client from the buntdb file at OAUTH2_CLIENTS_DB_PATH into
+// db, replacing clients with the same id. Secrets are copied already hashed.
+//
+// It's ran with 'auth migrate-clients' before switching to OAUTH2_CLIENTS_STORE=sql.
+func migrateClients(logger log.Logger, db *sql.DB) error {
+	from, err := openBuntClientStore()
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	clients, err := from.List()
+	if err != nil {
+		return fmt.Errorf("problem reading clients: %v", err)
+	}
+	to := &sqliteClientStore{db, logger}
+	for i := range clients {
+		if err := to.Set(clients[i].GetID(), clients[i]); err != nil {
+			return err
+		}
+	}
+	logger.Log("oauth", fmt.Sprintf("copied %d clients into %s", len(clients), dialectOf(db)))
+	return nil
+}
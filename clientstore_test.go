@@ -0,0 +1,185 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/auth/pkg/buntdbclient"
+	"github.com/moov-io/auth/pkg/oauthclient"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// testClientStore checks the behavior our handlers rely on from every clientStore.
+func testClientStore(t *testing.T, cs clientStore) {
+	t.Helper()
+
+	// get nothing
+	if _, err := cs.GetByID("moov"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("got %v", err)
+	}
+	if clients, err := cs.GetByUserID("userId"); clients != nil || err != nil {
+		t.Errorf("clients=%#v err=%v", clients, err)
+	}
+
+	// set and read back
+	now := time.Now()
+	cli := &oauthclient.Client{
+		Client:                  models.Client{ID: "moov", Secret: "second", Domain: "https://moov.io/cb", UserID: "userId"},
+		Name:                    "Moov",
+		Scope:                   "read write",
+		PreviousSecret:          "first",
+		PreviousSecretExpiresAt: now.Add(time.Hour),
+		CreatedAt:               now,
+	}
+	if err := cs.Set("moov", cli); err != nil {
+		t.Fatal(err)
+	}
+	if cli.Secret != "second" {
+		t.Errorf("Set modified client: %#v", cli)
+	}
+	if err := cs.Set("other", &models.Client{ID: "other", Secret: "secret", UserID: "userId"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Set("wrong", &models.Client{ID: "moov"}); err == nil {
+		t.Error("expected error")
+	}
+
+	found, err := cs.GetByID("moov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := found.(*oauthclient.Client)
+	if !ok {
+		t.Fatalf("got %T", found)
+	}
+	if c.GetDomain() != cli.Domain || c.GetUserID() != "userId" || c.Name != "Moov" || c.GetScope() != "read write" || !c.CreatedAt.Equal(now) {
+		t.Errorf("got %#v", c)
+	}
+	if c.GetSecret() == "second" || !c.VerifySecret("second") || !c.VerifySecret("first") || c.VerifySecret("third") {
+		t.Errorf("got %#v", c)
+	}
+
+	clients, err := cs.GetByUserID("userId")
+	if err != nil || len(clients) != 2 {
+		t.Fatalf("clients=%#v err=%v", clients, err)
+	}
+
+	// delete
+	if err := cs.DeleteByID("moov"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.GetByID("moov"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("got %v", err)
+	}
+	if clients, err := cs.GetByUserID("userId"); err != nil || len(clients) != 1 {
+		t.Errorf("clients=%#v err=%v", clients, err)
+	}
+}
+
+func TestClientStore__buntdb(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	cs, err := buntdbclient.New(filepath.Join(db.dir, "clients.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	testClientStore(t, cs)
+}
+
+func TestClientStore__sqlite(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	testClientStore(t, &sqliteClientStore{db.db, log.NewNopLogger()})
+}
+
+func TestClientStore__setup(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	os.Setenv("OAUTH2_CLIENTS_STORE", "sqlite")
+	defer os.Unsetenv("OAUTH2_CLIENTS_STORE")
+	cs, err := setupClientStore(log.NewNopLogger(), db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cs.(*sqliteClientStore); !ok {
+		t.Errorf("got %T", cs)
+	}
+
+	os.Setenv("OAUTH2_CLIENTS_STORE", "other")
+	if _, err := setupClientStore(log.NewNopLogger(), db.db); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestClientStore__migrateClients(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	path := filepath.Join(db.dir, "clients.db")
+	os.Setenv("OAUTH2_CLIENTS_DB_PATH", path)
+	defer os.Unsetenv("OAUTH2_CLIENTS_DB_PATH")
+
+	from, err := buntdbclient.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Set("first", &oauthclient.Client{Client: models.Client{ID: "first", Secret: "secret", UserID: "userId"}, Name: "First"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Set("second", &models.Client{ID: "second", Domain: "https://moov.io/cb", UserID: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	from.Close()
+
+	// running it twice is fine
+	for i := 0; i < 2; i++ {
+		if err := migrateClients(log.NewNopLogger(), db.db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	to := &sqliteClientStore{db.db, log.NewNopLogger()}
+	clients, err := to.List()
+	if err != nil || len(clients) != 2 {
+		t.Fatalf("clients=%#v err=%v", clients, err)
+	}
+	found, err := to.GetByID("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := found.(*oauthclient.Client); c.Name != "First" || !c.VerifySecret("secret") {
+		t.Errorf("got %#v", c)
+	}
+	found, err = to.GetByID("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.GetSecret() != "" || found.GetDomain() != "https://moov.io/cb" || found.GetUserID() != "other" {
+		t.Errorf("got %#v", found)
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// grant is the set of scopes a user has allowed an oauth client to use on their behalf.
+type grant struct {
+	ClientID  string    `json:"clientId"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// covers returns true if every scope in scope has been granted.
+func (g *grant) covers(scope string) bool {
+	if g == nil {
+		return false
+	}
+	return scopesCover(g.Scope, scope)
+}
+
+// scopesCover returns true if every scope in requested is in allowed (both space separated).
+func scopesCover(allowed, requested string) bool {
+	for _, s := range strings.Fields(requested) {
+		if !hasScope(allowed, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeScopes returns the scopes of a and b (space separated) without duplicates.
+func mergeScopes(a, b string) string {
+	var out []string
+	for _, s := range strings.Fields(a + " " + b) {
+		if !hasScope(strings.Join(out, " "), s) {
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// grantRepository stores the oauth clients users have authorized.
+type grantRepository interface {
+	// getGrant returns the user's grant to clientId, nil is returned if the
+	// user hasn't authorized the client.
+	getGrant(userId string, clientId string) (*grant, error)
+
+	// listGrants returns every grant the user has made.
+	listGrants(userId string) ([]*grant, error)
+
+	// writeGrant saves (replacing) the scopes the user has granted to clientId.
+	writeGrant(userId string, clientId string, scope string) error
+
+	// deleteGrant removes the user's grant to clientId. false is returned if
+	// the user hadn't authorized the client.
+	deleteGrant(userId string, clientId string) (bool, error)
+
+	// deleteGrants removes every grant the user has made.
+	deleteGrants(userId string) error
+}
+
+type sqliteGrantRepository struct {
+	db  *sql.DB
+	log log.Logger
+}
+
+func (s *sqliteGrantRepository) getGrant(userId string, clientId string) (*grant, error) {
+	stmt, err := s.db.Prepare(`select client_id, scope, created_at, updated_at from oauth2_grants where user_id = ? and client_id = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	g, err := scanGrant(stmt.QueryRow(userId, clientId))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return g, err
+}
+
+func (s *sqliteGrantRepository) listGrants(userId string) ([]*grant, error) {
+	stmt, err := s.db.Prepare(`select client_id, scope, created_at, updated_at from oauth2_grants where user_id = ? order by updated_at desc`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []*grant
+	for rows.Next() {
+		g, err := scanGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+func scanGrant(row interface{ Scan(...interface{}) error }) (*grant, error) {
+	var g grant
+	var createdAt, updatedAt string
+	if err := row.Scan(&g.ClientID, &g.Scope, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	var err error
+	if g.CreatedAt, err = time.Parse(serializedTimestampFormat, createdAt); err != nil {
+		return nil, err
+	}
+	if g.UpdatedAt, err = time.Parse(serializedTimestampFormat, updatedAt); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *sqliteGrantRepository) writeGrant(userId string, clientId string, scope string) error {
+	now := time.Now().Format(serializedTimestampFormat)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`insert into oauth2_grants (user_id, client_id, scope, created_at, updated_at) values (?, ?, ?, ?, ?) on conflict (user_id, client_id) do nothing`, userId, clientId, scope, now, now)
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem creating grant userId=%s clientId=%s, err=%v, rollback err=%v", userId, clientId, err, e)
+	}
+	_, err = tx.Exec(`update oauth2_grants set scope = ?, updated_at = ? where user_id = ? and client_id = ?`, scope, now, userId, clientId)
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem updating grant userId=%s clientId=%s, err=%v, rollback err=%v", userId, clientId, err, e)
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteGrantRepository) deleteGrant(userId string, clientId string) (bool, error) {
+	stmt, err := s.db.Prepare(`delete from oauth2_grants where user_id = ? and client_id = ?`)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(userId, clientId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteGrantRepository) deleteGrants(userId string) error {
+	stmt, err := s.db.Prepare(`delete from oauth2_grants where user_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId)
+	return err
+}
+
+// scopeDescriptions are shown on the consent page for scopes we know about.
+var scopeDescriptions = map[string]string{
+	"openid":  "Confirm who you are",
+	"profile": "See your name and company website",
+	"email":   "See your email address",
+	"phone":   "See your phone number",
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Authorize {{.ClientName}}</title>
+  </head>
+  <body>
+    <h1>{{.ClientName}} wants to access your account</h1>
+    <p>Signed in as {{.Email}}</p>
+    {{if .Scopes}}
+    <p>This will allow {{.ClientName}} to:</p>
+    <ul>
+      {{range .Scopes}}<li>{{.}}</li>
+      {{end}}
+    </ul>
+    {{end}}
+    <form method="post" action="{{.Action}}">
+      <input type="hidden" name="request" value="{{.Request}}">
+      <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+      <button type="submit" name="consent" value="deny">Deny</button>
+      <button type="submit" name="consent" value="allow">Allow</button>
+    </form>
+  </body>
+</html>
+`))
+
+// consentToken returns the CSRF token for consent forms shown to the session with cookie.
+// Other sites can't read our cookie so they can't build a valid form.
+func consentToken(cookie *http.Cookie) string {
+	if cookie == nil {
+		return ""
+	}
+	token, _ := hash("consent:" + cookie.Value)
+	return token
+}
+
+// renderConsent asks the user whether cli can have scope.
+func renderConsent(w http.ResponseWriter, r *http.Request, cli oauth2.ClientInfo, u *User, scope string) {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if desc, exists := scopeDescriptions[s]; exists {
+			scopes = append(scopes, desc)
+		} else {
+			scopes = append(scopes, s)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	err := consentTemplate.Execute(w, map[string]interface{}{
+		"ClientName": clientName(cli),
+		"Email":      u.Email,
+		"Scopes":     scopes,
+		"Action":     BaseURL + "/authorize",
+		"Request":    r.URL.RawQuery,
+		"CSRFToken":  consentToken(extractCookie(r)),
+	})
+	if err != nil {
+		internalError(w, err, "oauth")
+		return
+	}
+}
+
+// consentHandler records the user's answer from the consent page. Allowing the client
+// saves a grant and sends the user back to /authorize to finish the authorization request.
+func (o *oauth) consentHandler(auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			encodeError(w, errors.ErrInvalidRequest)
+			return
+		}
+		params, err := url.ParseQuery(r.PostForm.Get("request"))
+		if err != nil {
+			encodeError(w, errors.ErrInvalidRequest)
+			return
+		}
+		cli, err := o.manager.GetClient(params.Get("client_id"))
+		if err != nil || cli == nil {
+			encodeError(w, errors.ErrInvalidClient)
+			return
+		}
+		if err := validateRedirectURI(cli.GetDomain(), params.Get("redirect_uri")); err != nil {
+			encodeError(w, err)
+			return
+		}
+
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		expected := consentToken(extractCookie(r))
+		if userId == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(r.PostForm.Get("csrf_token"))) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		req := &server.AuthorizeRequest{
+			RedirectURI:  params.Get("redirect_uri"),
+			ResponseType: oauth2.Code,
+			ClientID:     cli.GetID(),
+			State:        params.Get("state"),
+			Request:      r,
+		}
+		if r.PostForm.Get("consent") != "allow" {
+			authFailures.With("method", "oauth2").Add(1)
+			o.authorizeError(w, req, errors.ErrAccessDenied)
+			return
+		}
+		if allowed, err := o.clientScopeHandler(cli.GetID(), params.Get("scope")); err != nil || !allowed {
+			o.authorizeError(w, req, errors.ErrInvalidScope)
+			return
+		}
+
+		g, err := o.grants.getGrant(userId, cli.GetID())
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		scope := params.Get("scope")
+		if g != nil {
+			scope = mergeScopes(g.Scope, scope)
+		}
+		if err := o.grants.writeGrant(userId, cli.GetID(), scope); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		http.Redirect(w, r, BaseURL+"/authorize?"+params.Encode(), http.StatusSeeOther)
+	}
+}
+
+// checkGrant returns true if u has authorized cli for scope. Users don't need to consent
+// to their own clients, we just record the grant.
+func (o *oauth) checkGrant(cli oauth2.ClientInfo, u *User, scope string) (bool, error) {
+	g, err := o.grants.getGrant(u.ID, cli.GetID())
+	if err != nil {
+		return false, err
+	}
+	if g.covers(scope) {
+		return true, nil
+	}
+	if cli.GetUserID() != u.ID {
+		return false, nil
+	}
+	if g != nil {
+		scope = mergeScopes(g.Scope, scope)
+	}
+	return true, o.grants.writeGrant(u.ID, cli.GetID(), scope)
+}
+
+func addGrantRoutes(router *mux.Router, logger log.Logger, auth authable, grantService grantRepository) {
+	router.Methods("GET").Path("/users/grants").HandlerFunc(listGrantsRoute(logger, auth, grantService))
+	router.Methods("DELETE").Path("/users/grants").HandlerFunc(deleteGrantsRoute(logger, auth, grantService))
+	router.Methods("DELETE").Path("/users/grants/{clientId}").HandlerFunc(deleteGrantRoute(logger, auth, grantService))
+}
+
+func listGrantsRoute(logger log.Logger, auth authable, grantService grantRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "grants")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		grants, err := grantService.listGrants(userId)
+		if err != nil {
+			internalError(w, err, "grants")
+			return
+		}
+
+		type response struct {
+			Grants []*grant `json:"grants"`
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(&response{grants}); err != nil {
+			internalError(w, err, "grants")
+			return
+		}
+	}
+}
+
+// deleteGrantsRoute revokes every client the user has authorized. Tokens issued under
+// a revoked grant stop working.
+func deleteGrantsRoute(logger log.Logger, auth authable, grantService grantRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "grants")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := grantService.deleteGrants(userId); err != nil {
+			internalError(w, err, "grants")
+			return
+		}
+		authInactivations.With("method", "oauth2").Add(1)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func deleteGrantRoute(logger log.Logger, auth authable, grantService grantRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "grants")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		found, err := grantService.deleteGrant(userId, mux.Vars(r)["clientId"])
+		if err != nil {
+			internalError(w, err, "grants")
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		authInactivations.With("method", "oauth2").Add(1)
+		w.WriteHeader(http.StatusOK)
+	}
+}
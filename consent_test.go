@@ -0,0 +1,202 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/auth/pkg/oauthclient"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestConsent__scopes(t *testing.T) {
+	g := &grant{Scope: "openid email"}
+	if !g.covers("email") || !g.covers("email openid") || !g.covers("") {
+		t.Error("expected grant to cover scopes")
+	}
+	if g.covers("openid phone") || (*grant)(nil).covers("") {
+		t.Error("unexpected coverage")
+	}
+	if v := mergeScopes("openid email", "email phone"); v != "openid email phone" {
+		t.Errorf("got %q", v)
+	}
+}
+
+func TestConsent__thirdPartyClient(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+
+	u := &User{ID: generateID(), Email: "test@moov.io", Verified: true, CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// client owned by someone else
+	redirectURI := "https://app.example.com/callback"
+	cli := &oauthclient.Client{
+		Client: models.Client{ID: "app", Secret: "secret", Domain: redirectURI, UserID: "other"},
+		Scope:  "openid email phone",
+	}
+	if err := o.clientStore.Set("app", cli); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addOAuthRoutes(router, o, log.NewNopLogger(), authService, userService)
+	addGrantRoutes(router, log.NewNopLogger(), authService, o.grants)
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	authorize := func(scope string) *httptest.ResponseRecorder {
+		params := url.Values{
+			"response_type": []string{"code"},
+			"client_id":     []string{"app"},
+			"redirect_uri":  []string{redirectURI},
+			"scope":         []string{scope},
+			"state":         []string{"xyz"},
+		}
+		return serve(httptest.NewRequest("GET", "/authorize?"+params.Encode(), nil))
+	}
+	hidden := regexp.MustCompile(`name="(request|csrf_token)" value="([^"]*)"`)
+	answer := func(page *httptest.ResponseRecorder, consent string, csrf bool) *httptest.ResponseRecorder {
+		form := url.Values{"consent": []string{consent}}
+		for _, m := range hidden.FindAllStringSubmatch(page.Body.String(), -1) {
+			if m[1] != "csrf_token" || csrf {
+				form.Set(m[1], html.UnescapeString(m[2]))
+			}
+		}
+		r := httptest.NewRequest("POST", "/authorize", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(r)
+	}
+
+	// consent page
+	page := authorize("openid email")
+	if page.Code != http.StatusOK || !strings.Contains(page.Body.String(), "See your email address") {
+		t.Fatalf("got %d: %s", page.Code, page.Body.String())
+	}
+	if v := page.Header().Get("X-Frame-Options"); v != "DENY" {
+		t.Errorf("X-Frame-Options: %q", v)
+	}
+
+	// answers need the CSRF token
+	if w := answer(page, "allow", false); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// scopes the client can't request aren't granted, even if the form is changed
+	tampered := httptest.NewRecorder()
+	tampered.Body.WriteString(strings.Replace(html.UnescapeString(page.Body.String()), "scope=openid+email", "scope=openid+email+admin", 1))
+	w := answer(tampered, "allow", true)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || loc.Query().Get("error") != "invalid_scope" {
+		t.Errorf("got %d: %s", w.Code, loc)
+	}
+	if g, err := o.grants.getGrant(u.ID, "app"); g != nil || err != nil {
+		t.Errorf("grant=%#v err=%v", g, err)
+	}
+
+	// deny
+	w = answer(page, "deny", true)
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || loc.Query().Get("error") != "access_denied" || loc.Query().Get("state") != "xyz" {
+		t.Errorf("got %d: %s", w.Code, loc)
+	}
+
+	// allow, then authorize again for a code
+	w = answer(page, "allow", true)
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusSeeOther || loc.Path != "/authorize" {
+		t.Fatalf("got %d: %s", w.Code, loc)
+	}
+	w = serve(httptest.NewRequest("GET", loc.RequestURI(), nil))
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || loc.Query().Get("code") == "" {
+		t.Fatalf("got %d: %s", w.Code, loc)
+	}
+	code, tok := requestToken(t, o, url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"client_id":     []string{"app"},
+		"client_secret": []string{"secret"},
+		"code":          []string{loc.Query().Get("code")},
+		"redirect_uri":  []string{redirectURI},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %#v", code, tok)
+	}
+
+	// granted scopes skip consent, new scopes ask again
+	if w := authorize("email"); w.Code != http.StatusFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := authorize("openid phone"); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// list grants
+	w = serve(httptest.NewRequest("GET", "/users/grants", nil))
+	var resp struct {
+		Grants []*grant `json:"grants"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Grants) != 1 || resp.Grants[0].ClientID != "app" || resp.Grants[0].Scope != "openid email" {
+		t.Fatalf("%#v", resp.Grants)
+	}
+
+	// revoking the grant revokes its tokens
+	if !validAccessToken(o, tok.AccessToken) {
+		t.Fatal("access token is invalid")
+	}
+	if w := serve(httptest.NewRequest("DELETE", "/users/grants/app", nil)); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if validAccessToken(o, tok.AccessToken) {
+		t.Error("access token is still valid")
+	}
+	if code, resp := requestToken(t, o, url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"client_id":     []string{"app"},
+		"client_secret": []string{"secret"},
+		"refresh_token": []string{tok.RefreshToken},
+	}); code == http.StatusOK {
+		t.Errorf("got %d: %#v", code, resp)
+	}
+	if w := serve(httptest.NewRequest("DELETE", "/users/grants/app", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := authorize("email"); w.Code != http.StatusOK {
+		t.Errorf("expected consent again, got %d", w.Code)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	errEncryptionNotConfigured = errors.New("ENCRYPTION_KEY is not configured")
+)
+
+// readEncryptionKey returns the AES-256 key used to encrypt secrets we store
+// (i.e. TOTP secrets). The key is read as base64 from ENCRYPTION_KEY.
+//
+// A nil key is returned if ENCRYPTION_KEY is empty.
+func readEncryptionKey() ([]byte, error) {
+	v := os.Getenv("ENCRYPTION_KEY")
+	if v == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ENCRYPTION_KEY: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("ENCRYPTION_KEY must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// encrypt seals plaintext with AES-GCM and returns the base64 encoded nonce and ciphertext.
+func encrypt(key []byte, plaintext []byte) (string, error) {
+	if len(key) == 0 {
+		return "", errEncryptionNotConfigured
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := gcm.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// decrypt opens a value returned from encrypt.
+func decrypt(key []byte, ciphertext string) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errEncryptionNotConfigured
+	}
+	bs, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, bs := bs[:gcm.NonceSize()], bs[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, bs, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,40 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCrypto__encrypt(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	ciphertext, err := encrypt(key, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := decrypt(key, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, []byte("secret")) {
+		t.Errorf("got %q", plaintext)
+	}
+
+	// wrong key
+	other := make([]byte, 32)
+	rand.Read(other)
+	if _, err := decrypt(other, ciphertext); err == nil {
+		t.Error("expected error")
+	}
+
+	// no key
+	if _, err := encrypt(nil, []byte("secret")); err != errEncryptionNotConfigured {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// forEachDatabase runs fn against a freshly migrated database of every dialect.
+//
+// Postgres is only tested when TEST_DATABASE_URL is set, for example:
+//
+//	TEST_DATABASE_URL=postgres://postgres@localhost:5432/postgres?sslmode=disable
+//
+// Each run gets its own schema which is dropped afterwards.
+func forEachDatabase(t *testing.T, fn func(t *testing.T, db *sql.DB)) {
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := createTestSqliteDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.close()
+		fn(t, db.db)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("TEST_DATABASE_URL")
+		if dsn == "" {
+			t.Skip("TEST_DATABASE_URL not set")
+		}
+		admin, err := createPostgresConnection(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer admin.Close()
+
+		schema := "auth_test_" + generateID()
+		if _, err := admin.Exec(`create schema ` + schema); err != nil {
+			t.Fatal(err)
+		}
+		defer admin.Exec(`drop schema ` + schema + ` cascade`)
+
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		db, err := createPostgresConnection(dsn + sep + "search_path=" + schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := migrate(db, log.NewNopLogger()); err != nil {
+			t.Fatal(err)
+		}
+		fn(t, db)
+	})
+}
+
+func TestDatabase__rebind(t *testing.T) {
+	cases := []struct {
+		input, expected string
+	}{
+		{`select 1`, `select 1`},
+		{`select a from b where c = ? and d > ?`, `select a from b where c = $1 and d > $2`},
+		{`insert into t (a, b) values (?, '?')`, `insert into t (a, b) values ($1, '?')`},
+		{`select "a?" from t where b = ?`, `select "a?" from t where b = $1`},
+	}
+	for i := range cases {
+		if res := rebind(cases[i].input); res != cases[i].expected {
+			t.Errorf("got %q", res)
+		}
+	}
+}
+
+func TestDatabase__openDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "auth.db")
+	os.Setenv("DATABASE_URL", "sqlite://"+path)
+	defer os.Unsetenv("DATABASE_URL")
+
+	db, desc, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if desc != path || dialectOf(db) != sqliteDialect {
+		t.Errorf("desc=%q dialect=%s", desc, dialectOf(db))
+	}
+
+	for _, v := range []string{"mysql://localhost/auth", "sqlite://../auth.db", "sqlite://"} {
+		os.Setenv("DATABASE_URL", v)
+		if _, _, err := openDatabase(); err == nil {
+			t.Errorf("%s: expected error", v)
+		}
+	}
+}
+
+func TestDatabase__postgresMigrations(t *testing.T) {
+	// every sqlite migration needs a postgres version at the same position
+	if len(postgresMigrations) != len(migrations) {
+		t.Errorf("%d postgres migrations, %d sqlite migrations", len(postgresMigrations), len(migrations))
+	}
+}
+
+// testUserRepository checks the behavior our handlers rely on from every userRepository.
+func testUserRepository(t *testing.T, repo userRepository) {
+	t.Helper()
+
+	if _, err := repo.lookupByEmail("jane@moov.io"); err == nil {
+		t.Error("expected error")
+	}
+
+	u := &User{
+		ID:        generateID(),
+		Email:     "jane.doe+test@moov.io",
+		FirstName: "Jane",
+		LastName:  "Doe",
+		Phone:     "555.555.5555",
+		CreatedAt: time.Now(),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	found, err := repo.lookupByEmail("janedoe@moov.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != u.ID || found.Email != u.Email || found.FirstName != "Jane" || !found.CreatedAt.Equal(u.CreatedAt) || !found.Verified {
+		t.Errorf("got %#v", found)
+	}
+
+	// update
+	u.FirstName, u.CompanyURL = "Janet", "https://moov.io"
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := repo.lookupByUserId(u.ID); err != nil || found.FirstName != "Janet" || found.CompanyURL != "https://moov.io" {
+		t.Errorf("user=%#v err=%v", found, err)
+	}
+
+	// approval codes
+	if err := repo.writeApprovalCode(u.ID, "expired", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.writeApprovalCode(u.ID, "code", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := repo.lookupByUserId(u.ID); found.Verified {
+		t.Errorf("got %#v", found)
+	}
+	if userId, err := repo.consumeApprovalCode("expired"); userId != "" || err != nil {
+		t.Errorf("userId=%q err=%v", userId, err)
+	}
+	if userId, err := repo.consumeApprovalCode("code"); userId != u.ID || err != nil {
+		t.Errorf("userId=%q err=%v", userId, err)
+	}
+	if userId, err := repo.consumeApprovalCode("code"); userId != "" || err != nil {
+		t.Errorf("userId=%q err=%v", userId, err)
+	}
+	if found, _ := repo.lookupByUserId(u.ID); !found.Verified {
+		t.Errorf("got %#v", found)
+	}
+
+	// delete
+	if err := repo.deleteUser(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.lookupByEmail(u.Email); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// testAuthable checks the behavior our handlers rely on from every authable.
+func testAuthable(t *testing.T, a authable) {
+	t.Helper()
+	userId := generateID()
+
+	// passwords
+	if err := a.checkPassword(userId, "password"); err == nil {
+		t.Error("expected error")
+	}
+	if err := a.writePassword(userId, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.writePassword(userId, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.checkPassword(userId, "password"); err == nil {
+		t.Error("expected error")
+	}
+	if err := a.checkPassword(userId, "secret"); err != nil {
+		t.Error(err)
+	}
+
+	// sessions
+	expires := time.Now().Add(time.Hour)
+	if err := a.writeCookie(userId, &http.Cookie{Value: "laptop", Expires: expires}, "laptop", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.writeCookie(userId, &http.Cookie{Value: "phone", Expires: expires}, "phone", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.writeCookie(userId, &http.Cookie{Value: "expired", Expires: time.Now().Add(-time.Minute)}, "old", "10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := a.findUserId("laptop"); id != userId || err != nil {
+		t.Errorf("userId=%q err=%v", id, err)
+	}
+	if id, err := a.findUserId("expired"); id != "" || err != nil {
+		t.Errorf("userId=%q err=%v", id, err)
+	}
+	sessions, err := a.listSessions(userId)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("sessions=%#v err=%v", sessions, err)
+	}
+	if sessions[0].UserAgent != "phone" || sessions[1].UserAgent != "laptop" || sessions[1].IPAddress != "10.0.0.1" || sessions[1].LastSeen.IsZero() {
+		t.Errorf("got %#v and %#v", sessions[0], sessions[1])
+	}
+	if ok, err := a.invalidateSession(userId, sessions[0].ID); !ok || err != nil {
+		t.Errorf("ok=%v err=%v", ok, err)
+	}
+	if ok, err := a.invalidateSession(userId, "other"); ok || err != nil {
+		t.Errorf("ok=%v err=%v", ok, err)
+	}
+	if err := a.invalidateCookie("laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := a.listSessions(userId); len(sessions) != 0 || err != nil {
+		t.Errorf("sessions=%#v err=%v", sessions, err)
+	}
+
+	// password resets and login links
+	writes := []func(string, string, time.Time) error{a.writePasswordReset, a.writeLoginLink}
+	consumes := []func(string) (string, error){a.consumePasswordReset, a.consumeLoginLink}
+	for i := range writes {
+		if err := writes[i](userId, "first", time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writes[i](userId, "second", time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if id, err := consumes[i]("first"); id != "" || err != nil {
+			t.Errorf("%d: userId=%q err=%v", i, id, err)
+		}
+		if id, err := consumes[i]("second"); id != userId || err != nil {
+			t.Errorf("%d: userId=%q err=%v", i, id, err)
+		}
+		if id, err := consumes[i]("second"); id != "" || err != nil {
+			t.Errorf("%d: userId=%q err=%v", i, id, err)
+		}
+	}
+}
+
+func TestUserRepository(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *sql.DB) {
+		testUserRepository(t, &sqliteUserRepository{db, log.NewNopLogger()})
+	})
+}
+
+func TestAuthable(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *sql.DB) {
+		testAuthable(t, &auth{db, log.NewNopLogger()})
+	})
+}
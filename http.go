@@ -6,10 +6,13 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -29,12 +32,25 @@ var (
 	//
 	// The path is always set to /.
 	Domain string = os.Getenv("DOMAIN")
+
+	// BaseURL is the public URL this service is reachable at, used when
+	// building links sent to users (i.e. email approval links).
+	// If empty it's built from Domain.
+	BaseURL string = os.Getenv("BASE_URL")
 )
 
 func init() {
 	if Domain == "" {
 		Domain = "localhost"
 	}
+	if BaseURL == "" {
+		if serveViaTLS {
+			BaseURL = fmt.Sprintf("https://%s", Domain)
+		} else {
+			BaseURL = fmt.Sprintf("http://%s", Domain)
+		}
+	}
+	BaseURL = strings.TrimSuffix(BaseURL, "/")
 }
 
 // read consumes an io.Reader (wrapping with io.LimitReader)
@@ -80,9 +96,34 @@ func extractCookie(r *http.Request) *http.Cookie {
 	return nil
 }
 
+// findUserIdFromCookie returns the userId associated with our cookie on r.
+// An empty userId is returned if the cookie is missing or not associated with a user.
+func findUserIdFromCookie(r *http.Request, auth authable) (string, error) {
+	cookie := extractCookie(r)
+	if cookie == nil {
+		return "", nil
+	}
+	return auth.findUserId(cookie.Value)
+}
+
+// clientIP returns the IP address of the client which made r. The first
+// X-Forwarded-For value is preferred as we're often behind a load balancer.
+//
+// This value can be spoofed by clients and is only meant to be informational.
+func clientIP(r *http.Request) string {
+	if v := r.Header.Get("X-Forwarded-For"); v != "" {
+		return strings.TrimSpace(strings.Split(v, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // createCookie generates a new cookie and associates it with the provided
-// userId.
-func createCookie(userId string, auth authable) (*http.Cookie, error) {
+// userId. A new session is saved for the client making r.
+func createCookie(userId string, r *http.Request, auth authable) (*http.Cookie, error) {
 	cookie := &http.Cookie{
 		Domain:   Domain,
 		Expires:  time.Now().Add(cookieTTL),
@@ -92,7 +133,7 @@ func createCookie(userId string, auth authable) (*http.Cookie, error) {
 		Secure:   serveViaTLS,
 		Value:    generateID(),
 	}
-	if err := auth.writeCookie(userId, cookie); err != nil {
+	if err := auth.writeCookie(userId, cookie, r.UserAgent(), clientIP(r)); err != nil {
 		return nil, err
 	}
 	return cookie, nil
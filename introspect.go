@@ -0,0 +1,67 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gopkg.in/oauth2.v3/errors"
+)
+
+// introspectionResponse is the RFC 7662 section 2.2 response. Only Active is
+// included for inactive tokens.
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// introspectHandler implements OAuth 2.0 Token Introspection (RFC 7662) for access
+// tokens. Callers (i.e. resource servers) authenticate with their client credentials
+// so tokens can't be scanned anonymously.
+//
+// Unknown, expired and revoked tokens are reported as inactive. So are tokens issued to
+// other clients, unless the caller is one of OAUTH2_INTROSPECTION_CLIENTS (RFC 7662
+// section 4).
+//
+// https://tools.ietf.org/html/rfc7662
+func (o *oauth) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	cli, err := o.authenticateClient(r)
+	if err != nil {
+		o.tokenError(w, err)
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		o.tokenError(w, errors.ErrInvalidRequest)
+		return
+	}
+
+	// LoadAccessToken is what ValidationBearerToken uses to check bearer tokens.
+	resp := &introspectionResponse{}
+	ti, err := o.manager.LoadAccessToken(token)
+	if err == nil && ti.GetClientID() != "" && (ti.GetClientID() == cli.GetID() || o.introspectionClients[cli.GetID()]) {
+		resp.Active = true
+		resp.ClientID = ti.GetClientID()
+		resp.Subject = ti.GetUserID()
+		resp.Scope = ti.GetScope()
+		resp.ExpiresAt = ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn()).Unix()
+		resp.IssuedAt = ti.GetAccessCreateAt().Unix()
+		resp.TokenType = o.server.Config.TokenType
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		internalError(w, err, "oauth")
+		return
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func introspectToken(t *testing.T, o *oauth, token string, username, password string) (int, *introspectionResponse) {
+	t.Helper()
+
+	form := url.Values{"token": []string{token}}
+	r := httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(username, password)
+	w := httptest.NewRecorder()
+	o.introspectHandler(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	var resp introspectionResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, &resp
+}
+
+func TestIntrospect(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	code, tok := requestToken(t, o, url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{"client"},
+		"client_secret": []string{"secret"},
+		"scope":         []string{"read"},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %#v", code, tok)
+	}
+
+	// unauthenticated callers are rejected
+	if code, _ := introspectToken(t, o, tok.AccessToken, "client", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("got %d", code)
+	}
+
+	code, resp := introspectToken(t, o, tok.AccessToken, "client", "secret")
+	if code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if !resp.Active || resp.ClientID != "client" || resp.Scope != "read" || resp.TokenType != "Bearer" {
+		t.Errorf("%#v", resp)
+	}
+	if resp.ExpiresAt <= time.Now().Unix() || resp.IssuedAt > time.Now().Unix() {
+		t.Errorf("exp=%d iat=%d", resp.ExpiresAt, resp.IssuedAt)
+	}
+
+	// refresh tokens and unknown tokens are inactive
+	for _, token := range []string{tok.RefreshToken, "unknown"} {
+		code, resp := introspectToken(t, o, token, "client", "secret")
+		if code != http.StatusOK || resp.Active || resp.ClientID != "" {
+			t.Errorf("got %d: %#v", code, resp)
+		}
+	}
+
+	// revoked tokens are inactive
+	if code := revokeToken(o, url.Values{"token": []string{tok.AccessToken}}, "client", "secret"); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if _, resp := introspectToken(t, o, tok.AccessToken, "client", "secret"); resp.Active {
+		t.Errorf("%#v", resp)
+	}
+}
+
+func TestIntrospect__otherClients(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	for _, id := range []string{"other", "resource-server"} {
+		if err := o.clientStore.Set(id, &models.Client{ID: id, Secret: "secret", Domain: Domain}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.introspectionClients["resource-server"] = true
+
+	code, tok := requestToken(t, o, url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{"client"},
+		"client_secret": []string{"secret"},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %#v", code, tok)
+	}
+
+	// tokens of other clients are inactive
+	if code, resp := introspectToken(t, o, tok.AccessToken, "other", "secret"); code != http.StatusOK || resp.Active || resp.ClientID != "" {
+		t.Errorf("got %d: %#v", code, resp)
+	}
+	// unless the caller is allowed to introspect them
+	if code, resp := introspectToken(t, o, tok.AccessToken, "resource-server", "secret"); code != http.StatusOK || !resp.Active || resp.ClientID != "client" {
+		t.Errorf("got %d: %#v", code, resp)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/oauth2.v3"
+)
+
+// signingKey is a private key we sign JWTs with.
+type signingKey struct {
+	// id is the RFC 7638 thumbprint of the public key, used as the JWT "kid" header
+	id     string
+	method jwt.SigningMethod
+	key    crypto.Signer
+
+	// state is managed by keyManager, see signingKeyActive
+	state       string
+	createdAt   time.Time
+	activatedAt time.Time
+	expiresAt   time.Time
+}
+
+// readSigningKey reads the PEM encoded private key at OAUTH2_JWT_SIGNING_KEY_PATH.
+// A nil key is returned if the env var is empty.
+func readSigningKey() (*signingKey, error) {
+	path := os.Getenv("OAUTH2_JWT_SIGNING_KEY_PATH")
+	if path == "" {
+		return nil, nil
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading OAUTH2_JWT_SIGNING_KEY_PATH: %v", err)
+	}
+	return parseSigningKey(bs)
+}
+
+// parseSigningKey reads a PEM encoded RSA (RS256) or P-256 ECDSA (ES256) private key.
+func parseSigningKey(bs []byte) (*signingKey, error) {
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, errors.New("no PEM block found in signing key")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("problem parsing signing key: %v", err)
+	}
+	return newSigningKey(key)
+}
+
+func newSigningKey(key interface{}) (*signingKey, error) {
+	out := &signingKey{}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA signing keys must be at least 2048 bits, got %d", k.N.BitLen())
+		}
+		out.method, out.key = jwt.SigningMethodRS256, k
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ECDSA signing keys must use P-256, got %s", k.Curve.Params().Name)
+		}
+		out.method, out.key = jwt.SigningMethodES256, k
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+
+	thumbprint, err := out.jwk().thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	out.id = thumbprint
+	return out, nil
+}
+
+// jwk is a public JSON Web Key (RFC 7517).
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// ECDSA
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+func (k *signingKey) jwk() jwk {
+	enc := base64.RawURLEncoding
+	out := jwk{
+		Use:       "sig",
+		KeyID:     k.id,
+		Algorithm: k.method.Alg(),
+	}
+	switch pub := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		out.KeyType = "RSA"
+		out.N = enc.EncodeToString(pub.N.Bytes())
+		out.E = enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// coordinates are padded to the curve size (RFC 7518 section 6.2.1.2)
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		out.KeyType = "EC"
+		out.Curve = pub.Curve.Params().Name
+		out.X = enc.EncodeToString(padBytes(pub.X.Bytes(), size))
+		out.Y = enc.EncodeToString(padBytes(pub.Y.Bytes(), size))
+	}
+	return out
+}
+
+// thumbprint returns the RFC 7638 thumbprint of k, which hashes only the
+// required members in lexicographic order.
+func (k jwk) thumbprint() (string, error) {
+	var bs []byte
+	var err error
+	switch k.KeyType {
+	case "RSA":
+		bs, err = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.KeyType, k.N})
+	case "EC":
+		bs, err = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Curve, k.KeyType, k.X, k.Y})
+	default:
+		return "", fmt.Errorf("unknown JWK key type %q", k.KeyType)
+	}
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(bs)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func padBytes(bs []byte, size int) []byte {
+	if len(bs) >= size {
+		return bs
+	}
+	out := make([]byte, size)
+	copy(out[size-len(bs):], bs)
+	return out
+}
+
+// jwtAccessClaims are the claims in our JWT access tokens.
+type jwtAccessClaims struct {
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+	jwt.StandardClaims
+}
+
+// jwtAccessGenerate is an oauth2.AccessGenerate which issues signed JWT access tokens,
+// so services can check tokens offline against our JWKS rather than calling /authorize.
+//
+// Tokens are still kept in the token store so they can be refreshed, revoked and
+// introspected. Revoking a JWT doesn't affect services which only check its signature.
+type jwtAccessGenerate struct {
+	keys *keyManager
+}
+
+func (g *jwtAccessGenerate) Token(data *oauth2.GenerateBasic, isGenRefresh bool) (string, string, error) {
+	// Tokens from client_credentials don't have a user, so they're for the client's owner.
+	sub := data.UserID
+	if sub == "" {
+		sub = data.Client.GetUserID()
+	}
+	ti := data.TokenInfo
+	claims := &jwtAccessClaims{
+		ClientID: data.Client.GetID(),
+		Scope:    ti.GetScope(),
+		StandardClaims: jwt.StandardClaims{
+			Id:        generateID(),
+			Issuer:    BaseURL,
+			Subject:   sub,
+			IssuedAt:  ti.GetAccessCreateAt().Unix(),
+			ExpiresAt: ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn()).Unix(),
+		},
+	}
+
+	key, err := g.keys.active()
+	if err != nil {
+		return "", "", err
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	access, err := token.SignedString(key.key)
+	if err != nil {
+		return "", "", err
+	}
+
+	var refresh string
+	if isGenRefresh {
+		refresh = generateID()
+		if refresh == "" {
+			return "", "", errors.New("problem generating refresh token")
+		}
+	}
+	return access, refresh, nil
+}
+
+// jwksHandler publishes the public keys JWTs are signed with (RFC 7517).
+// An empty set is returned when JWT access tokens aren't enabled.
+func (o *oauth) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Keys []jwk `json:"keys"`
+	}
+	resp := &response{Keys: []jwk{}}
+	if o.keys != nil {
+		resp.Keys = o.keys.publicKeys()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		internalError(w, err, "oauth")
+		return
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestJWT__thumbprint(t *testing.T) {
+	// RFC 7638 section 3.1
+	k := jwk{
+		KeyType: "RSA",
+		N:       "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:       "AQAB",
+		KeyID:   "ignored",
+	}
+	thumbprint, err := k.thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbprint != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("got %s", thumbprint)
+	}
+}
+
+func TestJWT__parseSigningKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecBytes, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		block *pem.Block
+		alg   string
+	}{
+		{&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, "RS256"},
+		{&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecBytes}, "ES256"},
+		{&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}, "ES256"},
+	}
+	for i := range cases {
+		key, err := parseSigningKey(pem.EncodeToMemory(cases[i].block))
+		if err != nil {
+			t.Errorf("%s: %v", cases[i].block.Type, err)
+			continue
+		}
+		if key.method.Alg() != cases[i].alg || key.id == "" {
+			t.Errorf("%s: alg=%s kid=%s", cases[i].block.Type, key.method.Alg(), key.id)
+		}
+	}
+
+	// P-384 isn't ES256
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	bs, _ := x509.MarshalECPrivateKey(p384)
+	if _, err := parseSigningKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bs})); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := parseSigningKey([]byte("not a key")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// publicKey rebuilds the public key from k, like a service reading our JWKS would.
+func (k jwk) publicKey(t *testing.T) interface{} {
+	t.Helper()
+
+	decode := func(s string) *big.Int {
+		bs, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return new(big.Int).SetBytes(bs)
+	}
+	switch k.KeyType {
+	case "RSA":
+		return &rsa.PublicKey{N: decode(k.N), E: int(decode(k.E).Int64())}
+	case "EC":
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: decode(k.X), Y: decode(k.Y)}
+	}
+	t.Fatalf("unknown kty %q", k.KeyType)
+	return nil
+}
+
+func TestJWT__accessTokens(t *testing.T) {
+	keys := map[string]*pem.Block{}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["RS256"] = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["ES256"] = &pem.Block{Type: "EC PRIVATE KEY", Bytes: bs}
+
+	for alg, block := range keys {
+		t.Run(alg, func(t *testing.T) {
+			db, err := createTestSqliteDB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.close()
+
+			path := filepath.Join(db.dir, "signing.pem")
+			if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+				t.Fatal(err)
+			}
+			os.Setenv("OAUTH2_JWT_SIGNING_KEY_PATH", path)
+			defer os.Unsetenv("OAUTH2_JWT_SIGNING_KEY_PATH")
+
+			o := createTestOAuth(t, db)
+			defer o.shutdown()
+			if err := o.clientStore.Set("client", &models.Client{ID: "client", Secret: "secret", Domain: Domain, UserID: "user"}); err != nil {
+				t.Fatal(err)
+			}
+
+			code, tok := requestToken(t, o, url.Values{
+				"grant_type":    []string{"client_credentials"},
+				"client_id":     []string{"client"},
+				"client_secret": []string{"secret"},
+				"scope":         []string{"read"},
+			})
+			if code != http.StatusOK {
+				t.Fatalf("got %d: %#v", code, tok)
+			}
+
+			// read our JWKS
+			w := httptest.NewRecorder()
+			o.jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+			w.Flush()
+			var jwks struct {
+				Keys []jwk `json:"keys"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&jwks); err != nil {
+				t.Fatal(err)
+			}
+			if len(jwks.Keys) != 2 { // active and next
+				t.Fatalf("%#v", jwks)
+			}
+
+			// validate the token offline
+			var claims jwtAccessClaims
+			token, err := jwt.ParseWithClaims(tok.AccessToken, &claims, func(token *jwt.Token) (interface{}, error) {
+				for i := range jwks.Keys {
+					if jwks.Keys[i].KeyID == token.Header["kid"] && jwks.Keys[i].Algorithm == alg {
+						return jwks.Keys[i].publicKey(t), nil
+					}
+				}
+				return nil, fmt.Errorf("kid=%v not found", token.Header["kid"])
+			})
+			if err != nil || !token.Valid {
+				t.Fatalf("token=%#v err=%v", token, err)
+			}
+			if token.Method.Alg() != alg {
+				t.Errorf("alg=%s", token.Method.Alg())
+			}
+			if claims.Subject != "user" || claims.ClientID != "client" || claims.Scope != "read" || claims.ExpiresAt == 0 {
+				t.Errorf("%#v", claims)
+			}
+
+			// JWTs work as regular bearer tokens and refresh
+			if !validAccessToken(o, tok.AccessToken) {
+				t.Error("access token isn't valid")
+			}
+			if code, resp := requestToken(t, o, refreshForm(tok.RefreshToken)); code != http.StatusOK {
+				t.Errorf("got %d: %#v", code, resp)
+			}
+		})
+	}
+}
+
+func TestJWT__jwksEmpty(t *testing.T) {
+	o := &oauth{}
+	w := httptest.NewRecorder()
+	o.jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if v := w.Body.String(); v != "{\"keys\":[]}\n" {
+		t.Errorf("got %q", v)
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Signing keys move through these states. A next key is published (so caches of
+// our JWKS pick it up) before it becomes active and signs anything. When the active
+// key is rotated out it's retired and stays published until everything it signed
+// has expired.
+const (
+	signingKeyNext    = "next"
+	signingKeyActive  = "active"
+	signingKeyRetired = "retired"
+)
+
+const (
+	defaultSigningKeyRotationPeriod = 30 * 24 * time.Hour
+
+	// signingKeyCheckInterval is how often we check if the active key is due for
+	// rotation and reload keys rotated by other instances.
+	signingKeyCheckInterval = time.Minute
+)
+
+var (
+	errNoActiveSigningKey = errors.New("no active signing key")
+)
+
+// keyManager holds the keys we sign JWTs with. Keys are stored in sqlite with their
+// private key encrypted by ENCRYPTION_KEY and cached in memory.
+type keyManager struct {
+	db  *sql.DB
+	log log.Logger
+
+	encryptionKey []byte
+
+	// method is the algorithm new keys are generated for
+	method jwt.SigningMethod
+
+	// rotationPeriod is how long a key stays active
+	rotationPeriod time.Duration
+
+	// tokenTTL is the longest lifetime of anything we sign, retired keys are
+	// published for this long after they're rotated out.
+	tokenTTL time.Duration
+
+	mu   sync.RWMutex
+	keys []*signingKey
+
+	stop chan struct{}
+}
+
+// setupKeyManager returns a keyManager if JWT signing is enabled, which happens when
+// OAUTH2_JWT_SIGNING_ALGORITHM or OAUTH2_JWT_SIGNING_KEY_PATH are set.
+//
+// A key read from OAUTH2_JWT_SIGNING_KEY_PATH is imported as the active key if there
+// isn't one already.
+func setupKeyManager(logger log.Logger, db *sql.DB, encryptionKey []byte, tokenTTL time.Duration) (*keyManager, error) {
+	imported, err := readSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	alg := os.Getenv("OAUTH2_JWT_SIGNING_ALGORITHM")
+	if alg == "" && imported == nil {
+		return nil, nil
+	}
+	if len(encryptionKey) == 0 {
+		return nil, fmt.Errorf("JWT signing keys require ENCRYPTION_KEY: %v", errEncryptionNotConfigured)
+	}
+
+	m := &keyManager{
+		db:            db,
+		log:           logger,
+		encryptionKey: encryptionKey,
+		tokenTTL:      tokenTTL,
+		stop:          make(chan struct{}),
+	}
+	switch alg {
+	case "":
+		m.method = imported.method
+	case jwt.SigningMethodRS256.Alg():
+		m.method = jwt.SigningMethodRS256
+	case jwt.SigningMethodES256.Alg():
+		m.method = jwt.SigningMethodES256
+	default:
+		return nil, fmt.Errorf("unsupported OAUTH2_JWT_SIGNING_ALGORITHM %q, use RS256 or ES256", alg)
+	}
+	m.rotationPeriod, err = readTokenTTL("OAUTH2_JWT_KEY_ROTATION_PERIOD", defaultSigningKeyRotationPeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	if imported != nil {
+		if err := m.importKey(imported); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.rotateIfDue(time.Now()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// generateSigningKey creates a new private key for method.
+func generateSigningKey(method jwt.SigningMethod) (*signingKey, error) {
+	switch method {
+	case jwt.SigningMethodRS256:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(key)
+	case jwt.SigningMethodES256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(key)
+	}
+	return nil, fmt.Errorf("unsupported signing method %s", method.Alg())
+}
+
+// active returns the key new JWTs should be signed with.
+func (m *keyManager) active() (*signingKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for i := range m.keys {
+		if m.keys[i].state == signingKeyActive {
+			return m.keys[i], nil
+		}
+	}
+	return nil, errNoActiveSigningKey
+}
+
+// publicKeys returns every published key, which is the next, active and retired keys.
+func (m *keyManager) publicKeys() []jwk {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]jwk, 0, len(m.keys))
+	for i := range m.keys {
+		out = append(out, m.keys[i].jwk())
+	}
+	return out
+}
+
+// load reads every key from the database into our cache.
+func (m *keyManager) load() error {
+	stmt, err := m.db.Prepare(`select private_key, state, created_at, activated_at, expires_at from oauth2_signing_keys order by created_at desc`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var keys []*signingKey
+	for rows.Next() {
+		var encrypted, state, createdAt, activatedAt, expiresAt string
+		if err := rows.Scan(&encrypted, &state, &createdAt, &activatedAt, &expiresAt); err != nil {
+			return err
+		}
+		bs, err := decrypt(m.encryptionKey, encrypted)
+		if err != nil {
+			return fmt.Errorf("problem decrypting signing key: %v", err)
+		}
+		key, err := parseSigningKey(bs)
+		if err != nil {
+			return err
+		}
+		key.state = state
+		key.createdAt, _ = time.Parse(serializedTimestampFormat, createdAt)
+		key.activatedAt, _ = time.Parse(serializedTimestampFormat, activatedAt)
+		key.expiresAt, _ = time.Parse(serializedTimestampFormat, expiresAt)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.keys = keys
+	m.mu.Unlock()
+	return nil
+}
+
+// importKey saves key as our active key unless we already have one.
+func (m *keyManager) importKey(key *signingKey) error {
+	m.mu.RLock()
+	for i := range m.keys {
+		if m.keys[i].id == key.id {
+			m.mu.RUnlock()
+			return nil // already imported
+		}
+	}
+	m.mu.RUnlock()
+	if _, err := m.active(); err == nil {
+		m.log.Log("keys", fmt.Sprintf("not importing signing key kid=%s, there's already an active key", key.id))
+		return nil
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	inserted, err := m.insertKey(tx, key, signingKeyActive, time.Now())
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem importing signing key kid=%s, err=%v, rollback err=%v", key.id, err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if inserted {
+		m.log.Log("keys", fmt.Sprintf("imported signing key kid=%s", key.id))
+	}
+	return m.load()
+}
+
+// insertKey saves key in state unless there's already a key in that state, i.e. when
+// another instance added one first. false is returned if key wasn't saved.
+func (m *keyManager) insertKey(tx *sql.Tx, key *signingKey, state string, now time.Time) (bool, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.key)
+	if err != nil {
+		return false, err
+	}
+	encrypted, err := encrypt(m.encryptionKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		return false, err
+	}
+	var activatedAt string
+	if state == signingKeyActive {
+		activatedAt = now.Format(serializedTimestampFormat)
+	}
+	query := `insert into oauth2_signing_keys (key_id, algorithm, private_key, state, created_at, activated_at, expires_at)
+select ?, ?, ?, ?, ?, ?, '' where not exists (select 1 from oauth2_signing_keys where state = ?)`
+	res, err := tx.Exec(query, key.id, key.method.Alg(), encrypted, state, now.Format(serializedTimestampFormat), activatedAt, state)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// rotateIfDue rotates keys when the active key is older than our rotation period,
+// creating the first keys if there are none. Retired keys which have expired are removed.
+func (m *keyManager) rotateIfDue(now time.Time) error {
+	m.mu.RLock()
+	var hasNext bool
+	var expired []string
+	for i := range m.keys {
+		k := m.keys[i]
+		if k.state == signingKeyNext {
+			hasNext = true
+		}
+		if k.state == signingKeyRetired && !k.expiresAt.IsZero() && k.expiresAt.Before(now) {
+			expired = append(expired, k.id)
+		}
+	}
+	m.mu.RUnlock()
+
+	if len(expired) > 0 {
+		if err := m.deleteKeys(expired); err != nil {
+			return err
+		}
+	}
+
+	active, err := m.active()
+	if err != nil || active.activatedAt.Add(m.rotationPeriod).Before(now) {
+		return m.rotate(now)
+	}
+	if !hasNext {
+		// i.e. after importing a key, publish the next key ahead of its rotation
+		if err := m.addNextKey(now); err != nil {
+			return err
+		}
+	}
+	if len(expired) > 0 || !hasNext {
+		return m.load()
+	}
+	return nil
+}
+
+// addNextKey generates a next key, unless another instance has already added one.
+func (m *keyManager) addNextKey(now time.Time) error {
+	key, err := generateSigningKey(m.method)
+	if err != nil {
+		return err
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := m.insertKey(tx, key, signingKeyNext, now); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem adding next signing key, err=%v, rollback err=%v", err, e)
+	}
+	return tx.Commit()
+}
+
+func (m *keyManager) deleteKeys(ids []string) error {
+	stmt, err := m.db.Prepare(`delete from oauth2_signing_keys where key_id = ? and state = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := range ids {
+		if _, err := stmt.Exec(ids[i], signingKeyRetired); err != nil {
+			return err
+		}
+		m.log.Log("keys", fmt.Sprintf("removed expired signing key kid=%s", ids[i]))
+	}
+	return nil
+}
+
+// rotate retires the active key, promotes the next key and generates a new next key.
+// The first active and next keys are generated if they don't exist.
+//
+// Rotations are conditional on the keys we read, so if another instance rotates
+// first we keep its keys.
+func (m *keyManager) rotate(now time.Time) error {
+	m.mu.RLock()
+	var active, next *signingKey
+	for i := range m.keys {
+		switch m.keys[i].state {
+		case signingKeyActive:
+			active = m.keys[i]
+		case signingKeyNext:
+			next = m.keys[i]
+		}
+	}
+	m.mu.RUnlock()
+
+	// generate keys before starting a transaction as RSA keys are slow
+	newNext, err := generateSigningKey(m.method)
+	if err != nil {
+		return err
+	}
+	var newActive *signingKey
+	if next == nil {
+		newActive, err = generateSigningKey(m.method)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	rollback := func(err error) error {
+		e := tx.Rollback()
+		return fmt.Errorf("problem rotating signing keys, err=%v, rollback err=%v", err, e)
+	}
+	// conflict is true when another instance changed the key first
+	conflict := func(res sql.Result) bool {
+		n, err := res.RowsAffected()
+		return err != nil || n != 1
+	}
+
+	if active != nil {
+		query := `update oauth2_signing_keys set state = ?, expires_at = ? where key_id = ? and state = ?`
+		res, err := tx.Exec(query, signingKeyRetired, now.Add(m.tokenTTL).Format(serializedTimestampFormat), active.id, signingKeyActive)
+		if err != nil {
+			return rollback(err)
+		}
+		if conflict(res) {
+			tx.Rollback()
+			return m.load()
+		}
+	}
+	if next != nil {
+		query := `update oauth2_signing_keys set state = ?, activated_at = ? where key_id = ? and state = ?`
+		res, err := tx.Exec(query, signingKeyActive, now.Format(serializedTimestampFormat), next.id, signingKeyNext)
+		if err != nil {
+			return rollback(err)
+		}
+		if conflict(res) {
+			tx.Rollback()
+			return m.load()
+		}
+	} else {
+		inserted, err := m.insertKey(tx, newActive, signingKeyActive, now)
+		if err != nil {
+			return rollback(err)
+		}
+		if !inserted {
+			tx.Rollback()
+			return m.load()
+		}
+	}
+	inserted, err := m.insertKey(tx, newNext, signingKeyNext, now)
+	if err != nil {
+		return rollback(err)
+	}
+	if !inserted {
+		tx.Rollback()
+		return m.load()
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := m.load(); err != nil {
+		return err
+	}
+	if k, err := m.active(); err == nil {
+		m.log.Log("keys", fmt.Sprintf("rotated signing keys, active kid=%s", k.id))
+	}
+	return nil
+}
+
+// run periodically rotates keys when they're due until shutdown is called.
+func (m *keyManager) run() {
+	tick := time.NewTicker(signingKeyCheckInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			// pick up rotations from other instances first
+			if err := m.load(); err != nil {
+				m.log.Log("keys", fmt.Sprintf("problem loading signing keys: %v", err))
+				continue
+			}
+			if err := m.rotateIfDue(time.Now()); err != nil {
+				m.log.Log("keys", fmt.Sprintf("problem rotating signing keys: %v", err))
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *keyManager) shutdown() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+}
+
+// listKeysHandler is an admin endpoint which lists our signing keys (but not their private keys).
+func (m *keyManager) listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	type key struct {
+		ID          string     `json:"id"`
+		Algorithm   string     `json:"algorithm"`
+		State       string     `json:"state"`
+		CreatedAt   time.Time  `json:"createdAt"`
+		ActivatedAt *time.Time `json:"activatedAt,omitempty"`
+		ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	}
+	type response struct {
+		Keys []key `json:"keys"`
+	}
+	resp := &response{Keys: []key{}}
+
+	m.mu.RLock()
+	for i := range m.keys {
+		k := m.keys[i]
+		out := key{ID: k.id, Algorithm: k.method.Alg(), State: k.state, CreatedAt: k.createdAt}
+		if !k.activatedAt.IsZero() {
+			out.ActivatedAt = &k.activatedAt
+		}
+		if !k.expiresAt.IsZero() {
+			out.ExpiresAt = &k.expiresAt
+		}
+		resp.Keys = append(resp.Keys, out)
+	}
+	m.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		internalError(w, err, "keys")
+		return
+	}
+}
+
+// rotateKeysHandler is an admin endpoint which rotates our signing keys right away,
+// i.e. if a key is compromised. Run it twice to also replace the published next key.
+func (m *keyManager) rotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if err := m.rotate(time.Now()); err != nil {
+		internalError(w, err, "keys")
+		return
+	}
+	m.listKeysHandler(w, r)
+}
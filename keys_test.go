@@ -0,0 +1,234 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func createTestKeyManager(t *testing.T, db *testSqliteDB, encryptionKey []byte) *keyManager {
+	t.Helper()
+
+	os.Setenv("OAUTH2_JWT_SIGNING_ALGORITHM", "ES256")
+	defer os.Unsetenv("OAUTH2_JWT_SIGNING_ALGORITHM")
+
+	m, err := setupKeyManager(log.NewNopLogger(), db.db, encryptionKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil {
+		t.Fatal("nil keyManager")
+	}
+	return m
+}
+
+func keyStates(m *keyManager) map[string]int {
+	out := make(map[string]int)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.keys {
+		out[m.keys[i].state]++
+	}
+	return out
+}
+
+func TestKeys__disabled(t *testing.T) {
+	m, err := setupKeyManager(log.NewNopLogger(), nil, nil, time.Hour)
+	if m != nil || err != nil {
+		t.Errorf("m=%v err=%v", m, err)
+	}
+
+	// ENCRYPTION_KEY is required
+	os.Setenv("OAUTH2_JWT_SIGNING_ALGORITHM", "ES256")
+	defer os.Unsetenv("OAUTH2_JWT_SIGNING_ALGORITHM")
+	if _, err := setupKeyManager(log.NewNopLogger(), nil, nil, time.Hour); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestKeys__rotation(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	encryptionKey := make([]byte, 32)
+	rand.Read(encryptionKey)
+	m := createTestKeyManager(t, db, encryptionKey)
+
+	// first keys are generated
+	if states := keyStates(m); states[signingKeyActive] != 1 || states[signingKeyNext] != 1 {
+		t.Fatalf("%v", states)
+	}
+	first, err := m.active()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not due yet
+	if err := m.rotateIfDue(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := m.active(); k.id != first.id {
+		t.Errorf("rotated early")
+	}
+
+	// next key is promoted and the old key is retired
+	var next string
+	for _, k := range m.keys {
+		if k.state == signingKeyNext {
+			next = k.id
+		}
+	}
+	if err := m.rotateIfDue(time.Now().Add(defaultSigningKeyRotationPeriod + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := m.active()
+	if second.id != next {
+		t.Errorf("expected kid=%s to be active, got kid=%s", next, second.id)
+	}
+	if states := keyStates(m); states[signingKeyActive] != 1 || states[signingKeyNext] != 1 || states[signingKeyRetired] != 1 {
+		t.Fatalf("%v", states)
+	}
+	if n := len(m.publicKeys()); n != 3 {
+		t.Errorf("got %d public keys", n)
+	}
+
+	// retired keys are removed after tokens signed with them expire
+	if err := m.rotateIfDue(time.Now().Add(defaultSigningKeyRotationPeriod + 2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if states := keyStates(m); states[signingKeyRetired] != 0 {
+		t.Errorf("%v", states)
+	}
+	if k, _ := m.active(); k.id != second.id {
+		t.Errorf("unexpected rotation")
+	}
+
+	// private keys are encrypted at rest
+	var stored string
+	if err := db.db.QueryRow(`select private_key from oauth2_signing_keys where key_id = ?`, second.id).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "PRIVATE KEY") {
+		t.Error("private key isn't encrypted")
+	}
+
+	// keys survive a restart
+	other := createTestKeyManager(t, db, encryptionKey)
+	if k, _ := other.active(); k.id != second.id {
+		t.Errorf("expected kid=%s, got kid=%s", second.id, k.id)
+	}
+}
+
+func TestKeys__concurrentRotation(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	encryptionKey := make([]byte, 32)
+	rand.Read(encryptionKey)
+	m1 := createTestKeyManager(t, db, encryptionKey)
+	m2 := createTestKeyManager(t, db, encryptionKey)
+
+	// both instances decide to rotate, only one rotation happens
+	if err := m1.rotate(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.rotate(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	k1, _ := m1.active()
+	k2, _ := m2.active()
+	if k1.id != k2.id {
+		t.Errorf("instances disagree: kid=%s vs kid=%s", k1.id, k2.id)
+	}
+	if states := keyStates(m2); states[signingKeyActive] != 1 || states[signingKeyNext] != 1 || states[signingKeyRetired] != 1 {
+		t.Errorf("%v", states)
+	}
+}
+
+func TestKeys__concurrentNextKey(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	encryptionKey := make([]byte, 32)
+	rand.Read(encryptionKey)
+	m1 := createTestKeyManager(t, db, encryptionKey)
+	m2 := createTestKeyManager(t, db, encryptionKey)
+
+	// i.e. after importing a key, both instances add a next key
+	if _, err := db.db.Exec(`delete from oauth2_signing_keys where state = ?`, signingKeyNext); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*keyManager{m1, m2} {
+		if err := m.load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range []*keyManager{m1, m2} {
+		if err := m.rotateIfDue(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m1.load(); err != nil {
+		t.Fatal(err)
+	}
+	if states := keyStates(m1); states[signingKeyActive] != 1 || states[signingKeyNext] != 1 {
+		t.Errorf("%v", states)
+	}
+}
+
+func TestKeys__adminRoutes(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	encryptionKey := make([]byte, 32)
+	rand.Read(encryptionKey)
+	m := createTestKeyManager(t, db, encryptionKey)
+	before, _ := m.active()
+
+	w := httptest.NewRecorder()
+	m.rotateKeysHandler(w, httptest.NewRequest("POST", "/oauth2/signing-keys/rotate", nil))
+	w.Flush()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	var resp struct {
+		Keys []struct {
+			ID    string `json:"id"`
+			State string `json:"state"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Keys) != 3 {
+		t.Fatalf("%#v", resp)
+	}
+	for _, k := range resp.Keys {
+		if k.ID == before.id && k.State != signingKeyRetired {
+			t.Errorf("kid=%s is %s", k.ID, k.State)
+		}
+	}
+}
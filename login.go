@@ -17,9 +17,9 @@ type loginRequest struct {
 	Password string `json:"password"`
 }
 
-func addLoginRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository) {
+func addLoginRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, mfaService mfaRepository, mailer mailer) {
 	router.Methods("GET").Path("/users/login").HandlerFunc(checkLogin(logger, auth, userService))
-	router.Methods("POST").Path("/users/login").HandlerFunc(loginRoute(logger, auth, userService))
+	router.Methods("POST").Path("/users/login").HandlerFunc(loginRoute(logger, auth, userService, mfaService, mailer))
 }
 
 func checkLogin(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
@@ -40,11 +40,20 @@ func checkLogin(logger log.Logger, auth authable, userService userRepository) ht
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+		u, err := userService.lookupByUserId(userId)
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+		if u == nil || !u.Verified {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func loginRoute(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+func loginRoute(logger log.Logger, auth authable, userService userRepository, mfaService mfaRepository, mailer mailer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Body == nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -83,28 +92,55 @@ func loginRoute(logger log.Logger, auth authable, userService userRepository) ht
 			return
 		}
 
-		// success route, let's finish!
-		authSuccesses.With("method", "web").Add(1)
-		cookie, err := createCookie(u.ID, auth)
-		if err != nil {
-			internalError(w, err, "login")
+		// unverified users can't login, but we send them a fresh approval
+		// code in case their previous one expired.
+		if !u.Verified {
+			authFailures.With("method", "web").Add(1)
+			if err := sendApprovalCode(u, userService, mailer); err != nil {
+				internalError(w, err, "login")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": "email address not verified",
+			})
 			return
 		}
-		if cookie == nil {
-			logger.Log("login", fmt.Sprintf("nil cookie for userId=%s", u.ID))
+
+		// users with a second factor need to provide it before we issue a cookie
+		enrollment, err := mfaService.getTOTP(u.ID)
+		if err != nil {
 			internalError(w, err, "login")
 			return
 		}
-		if err := auth.writeCookie(u.ID, cookie); err != nil {
-			internalError(w, err, "login")
+		if enrollment != nil && enrollment.confirmed {
+			startMFAChallenge(w, u.ID, mfaService)
 			return
 		}
 
-		http.SetCookie(w, cookie)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		if err := json.NewEncoder(w).Encode(u); err != nil {
-			internalError(w, err, "login")
-			return
-		}
+		// success route, let's finish!
+		completeLogin(w, r, u, auth, "web")
+	}
+}
+
+// completeLogin issues a new cookie (and session) for u and writes u back as JSON.
+// method is used as the label on our authSuccesses metric.
+func completeLogin(w http.ResponseWriter, r *http.Request, u *User, auth authable, method string) {
+	authSuccesses.With("method", method).Add(1)
+	cookie, err := createCookie(u.ID, r, auth)
+	if err != nil {
+		internalError(w, err, "login")
+		return
+	}
+	if cookie == nil {
+		internalError(w, fmt.Errorf("nil cookie for userId=%s", u.ID), "login")
+		return
+	}
+	http.SetCookie(w, cookie)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(u); err != nil {
+		internalError(w, err, "login")
+		return
 	}
 }
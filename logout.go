@@ -15,6 +15,8 @@ func addLogoutRoutes(router *mux.Router, logger log.Logger, auth authable) {
 	router.Methods("DELETE").Path("/users/login").HandlerFunc(logoutRoute(auth))
 }
 
+// logoutRoute removes the current session only. Use DELETE /users/sessions
+// to logout everywhere.
 func logoutRoute(auth authable) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cookie := extractCookie(r)
@@ -22,12 +24,7 @@ func logoutRoute(auth authable) func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		userId, err := auth.findUserId(cookie.Value)
-		if err != nil {
-			internalError(w, err, "logout")
-			return
-		}
-		if err := auth.invalidateCookies(userId); err != nil {
+		if err := auth.invalidateCookie(cookie.Value); err != nil {
 			logger.Log("logout", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
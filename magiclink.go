@@ -0,0 +1,114 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	loginLinkTTL = 15 * time.Minute
+)
+
+type loginLinkRequest struct {
+	Email string `json:"email"`
+}
+
+func addMagicLinkRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, mfaService mfaRepository, mailer mailer) {
+	router.Methods("POST").Path("/users/login/link").HandlerFunc(sendLoginLinkRoute(logger, auth, userService, mailer))
+	router.Methods("GET").Path("/users/login/link/{token}").HandlerFunc(loginLinkRoute(logger, auth, userService, mfaService))
+}
+
+// sendLoginLinkRoute emails a single-use login link to verified users.
+//
+// "200 OK" is always returned (even for unknown emails) to avoid leaking
+// which email addresses have accounts.
+func sendLoginLinkRoute(logger log.Logger, auth authable, userService userRepository, mailer mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+		var req loginLinkRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		u, err := userService.lookupByEmail(req.Email)
+		if err != nil || u == nil || !u.Verified {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if err := sendLoginLink(u, auth, mailer); err != nil {
+			logger.Log("login", fmt.Sprintf("problem sending login link for userId=%s: %v", u.ID, err))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// sendLoginLink emails u a link which logs them in. The token is random and only
+// its SHA256 checksum is stored, so it can't be forged or recovered from our database.
+func sendLoginLink(u *User, auth authable, m mailer) error {
+	token := generateID()
+	if token == "" {
+		return errors.New("problem generating login link token")
+	}
+	if err := auth.writeLoginLink(u.ID, token, time.Now().Add(loginLinkTTL)); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/users/login/link/%s", BaseURL, url.PathEscape(token))
+	body := fmt.Sprintf("Visit the following link to login. It expires in %v and can only be used once.\n\n%s\n\nIf you didn't request this you can ignore this email.\n", loginLinkTTL, link)
+	return m.send(u.Email, "Your login link", body)
+}
+
+// loginLinkRoute consumes a login link token and logs the user in like loginRoute,
+// including asking for a second factor if the user has one.
+func loginLinkRoute(logger log.Logger, auth authable, userService userRepository, mfaService mfaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := auth.consumeLoginLink(mux.Vars(r)["token"])
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+		if userId == "" {
+			authFailures.With("method", "magic_link").Add(1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		u, err := userService.lookupByUserId(userId)
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+
+		enrollment, err := mfaService.getTOTP(u.ID)
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+		if enrollment != nil && enrollment.confirmed {
+			startMFAChallenge(w, u.ID, mfaService)
+			return
+		}
+
+		completeLogin(w, r, u, auth, "magic_link")
+	}
+}
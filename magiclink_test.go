@@ -0,0 +1,97 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+var loginLinkPath = regexp.MustCompile(`(/users/login/link/[a-z0-9]+)`)
+
+func TestMagicLink__login(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+	mfaService := &sqliteMFARepository{db.db, log.NewNopLogger(), nil}
+	m := &testMailer{}
+
+	u := &User{ID: generateID(), Email: "test@moov.io", CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addMagicLinkRoutes(router, log.NewNopLogger(), authService, userService, mfaService, m)
+
+	// unknown emails get the same response
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login/link", strings.NewReader(`{"email": "other@moov.io"}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login/link", strings.NewReader(`{"email": "test@moov.io"}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if len(m.bodies) != 1 {
+		t.Fatalf("got %d emails", len(m.bodies))
+	}
+	matches := loginLinkPath.FindStringSubmatch(m.bodies[u.Email])
+	if len(matches) != 2 {
+		t.Fatalf("no login link found in %q", m.bodies[u.Email])
+	}
+
+	// follow the link
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", matches[1], nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies", len(cookies))
+	}
+	if userId, _ := authService.findUserId(cookies[0].Value); userId != u.ID {
+		t.Errorf("got userId=%q", userId)
+	}
+
+	// links are single use
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", matches[1], nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestMagicLink__expired(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	if err := authService.writeLoginLink("userId", "token", time.Now().Add(-1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if userId, err := authService.consumeLoginLink("token"); userId != "" || err != nil {
+		t.Errorf("got userId=%q, err=%v", userId, err)
+	}
+}
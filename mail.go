@@ -0,0 +1,88 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+)
+
+// mailer represents something capable of sending emails to our users.
+// (i.e. email approval links)
+type mailer interface {
+	send(to string, subject string, body string) error
+}
+
+// setupMailer returns a mailer configured from SMTP_* environment variables.
+//
+// If SMTP_ADDR is empty emails are written to logger instead of being sent,
+// which is only suitable for local development.
+func setupMailer(logger log.Logger) (mailer, error) {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		logger.Log("mail", "SMTP_ADDR not set, emails will only be logged")
+		return &logMailer{logger}, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR %q: %v", addr, err)
+	}
+
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = fmt.Sprintf("noreply@%s", Domain)
+	}
+
+	m := &smtpMailer{
+		addr: addr,
+		from: from,
+	}
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		m.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m, nil
+}
+
+// logMailer writes emails to a log.Logger rather than sending them.
+type logMailer struct {
+	logger log.Logger
+}
+
+func (m *logMailer) send(to string, subject string, body string) error {
+	m.logger.Log("mail", fmt.Sprintf("to=%s subject=%q", to, subject), "body", body)
+	return nil
+}
+
+// smtpMailer sends emails through an SMTP server.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) send(to string, subject string, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return errors.New("invalid email headers")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(body)
+
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{to}, buf.Bytes()); err != nil {
+		return fmt.Errorf("problem sending email: %v", err)
+	}
+	return nil
+}
@@ -80,7 +80,7 @@ func main() {
 	go admin.Init()
 
 	// migrate database
-	db, err := migrate(logger)
+	db, dbDescription, err := openDatabase()
 	if err != nil {
 		logger.Log("sqlite", err)
 		os.Exit(1)
@@ -90,11 +90,46 @@ func main() {
 			logger.Log("sqlite", err)
 		}
 	}()
+	if flag.Arg(0) == "migrate" {
+		if err := migrateCommand(os.Stdout, db, logger, flag.Args()[1:]); err != nil {
+			logger.Log("sqlite", err)
+			os.Exit(1)
+		}
+		return
+	}
+	logger.Log("sqlite", fmt.Sprintf("migrating %s", dbDescription))
+	if err := migrate(db, logger); err != nil {
+		logger.Log("sqlite", err)
+		os.Exit(1)
+	}
 
-	oauth, err := setupOauthServer(logger)
+	// one-shot commands
+	switch flag.Arg(0) {
+	case "":
+	case "migrate-clients":
+		if err := migrateClients(logger, db); err != nil {
+			logger.Log("oauth", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		logger.Log("main", fmt.Sprintf("unknown command %q", flag.Arg(0)))
+		os.Exit(1)
+	}
+
+	encryptionKey, err := readEncryptionKey()
+	if err != nil {
+		logger.Log("main", err)
+		os.Exit(1)
+	}
+	if encryptionKey == nil {
+		logger.Log("main", "ENCRYPTION_KEY not set, TOTP enrollment is disabled")
+	}
+
+	oauth, err := setupOauthServer(logger, db, encryptionKey)
 	if err != nil {
 		logger.Log("oauth", err)
-		errs <- err
+		os.Exit(1)
 	}
 	defer func() {
 		if err := oauth.shutdown(); err != nil {
@@ -111,14 +146,32 @@ func main() {
 		db:  db,
 		log: logger,
 	}
+	mfaService := &sqliteMFARepository{
+		db:  db,
+		log: logger,
+		key: encryptionKey,
+	}
+
+	mailer, err := setupMailer(logger)
+	if err != nil {
+		logger.Log("mail", err)
+		os.Exit(1)
+	}
 
 	// api routes
 	router := mux.NewRouter()
-	addOAuthRoutes(router, oauth, logger, authService)
-	addLoginRoutes(router, logger, authService, userService)
+	addOAuthRoutes(router, oauth, logger, authService, userService)
+	addLoginRoutes(router, logger, authService, userService, mfaService, mailer)
+	addMFARoutes(router, logger, authService, userService, mfaService)
+	addRecoveryCodeRoutes(router, logger, authService, mfaService)
 	addLogoutRoutes(router, logger, authService)
-	addSignupRoutes(router, logger, authService, userService)
-	// TODO(adam): profile CRU[D] routes
+	addMagicLinkRoutes(router, logger, authService, userService, mfaService, mailer)
+	addPasswordRoutes(router, logger, authService, userService, mfaService, mailer)
+	addProfileRoutes(router, logger, authService, userService, oauth)
+	addGrantRoutes(router, logger, authService, oauth.grants)
+	addSessionRoutes(router, logger, authService)
+	addSignupRoutes(router, logger, authService, userService, mailer)
+	addVerifyRoutes(router, logger, userService)
 
 	readTimeout, _ := time.ParseDuration("30s")
 	writTimeout, _ := time.ParseDuration("30s")
@@ -145,6 +198,12 @@ func main() {
 
 	adminService := admin.SetupServer()
 	defer adminService.Shutdown()
+	if oauth.keys != nil {
+		adminService.AddHandler("GET", "/oauth2/signing-keys", oauth.keys.listKeysHandler)
+		adminService.AddHandler("POST", "/oauth2/signing-keys/rotate", oauth.keys.rotateKeysHandler)
+	}
+	adminService.AddHandler("GET", "/oauth2/tokens", oauth.tokens.listTokensHandler)
+	adminService.AddHandler("DELETE", "/oauth2/tokens", oauth.tokens.revokeTokensHandler)
 
 	go func() {
 		logger.Log("admin", fmt.Sprintf("Starting admin service on %s", adminService.BindAddress()))
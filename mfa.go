@@ -0,0 +1,507 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// mfaChallengeTTL is how long a user has after a successful password check
+	// to provide their second factor.
+	mfaChallengeTTL = 5 * time.Minute
+
+	// mfaChallengeAttempts is how many codes can be tried against an mfaToken.
+	mfaChallengeAttempts = 5
+)
+
+type totpEnrollment struct {
+	secret    string
+	confirmed bool
+}
+
+// mfaRepository stores second factors for users and the pending logins
+// waiting on a second factor.
+type mfaRepository interface {
+	// getTOTP returns the user's TOTP enrollment, nil is returned if
+	// the user hasn't enrolled.
+	getTOTP(userId string) (*totpEnrollment, error)
+
+	// writeTOTP saves (replacing) the user's TOTP secret.
+	writeTOTP(userId string, secret string, confirmed bool) error
+
+	// deleteTOTP removes the user's TOTP secret and recovery codes.
+	deleteTOTP(userId string) error
+
+	// useTOTPStep marks step as used for the user. false is returned if step (or
+	// a later step) has already been used, which means the code is being replayed.
+	useTOTPStep(userId string, step int64) (bool, error)
+
+	// writeMFAChallenge saves a pending login for the user.
+	writeMFAChallenge(userId string, token string, validUntil time.Time) error
+
+	// findMFAChallenge returns the userId for a pending login and counts an attempt
+	// against it. An empty userId is returned if the token is unknown, expired or
+	// out of attempts.
+	findMFAChallenge(token string) (string, error)
+
+	deleteMFAChallenge(token string) error
+
+	// writeRecoveryCodes replaces the user's recovery codes with codes.
+	writeRecoveryCodes(userId string, codes []string) error
+
+	// consumeRecoveryCode checks code against the user's unused recovery codes,
+	// deleting it if found. false is returned if no codes matched.
+	consumeRecoveryCode(userId string, code string) (bool, error)
+
+	// countRecoveryCodes returns how many unused recovery codes the user has.
+	countRecoveryCodes(userId string) (int, error)
+}
+
+type sqliteMFARepository struct {
+	db  *sql.DB
+	log log.Logger
+
+	// key encrypts TOTP secrets, see readEncryptionKey
+	key []byte
+}
+
+func (s *sqliteMFARepository) getTOTP(userId string) (*totpEnrollment, error) {
+	stmt, err := s.db.Prepare(`select secret, confirmed from user_totp where user_id = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var secret string
+	var confirmed bool
+	if err := stmt.QueryRow(userId).Scan(&secret, &confirmed); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	bs, err := decrypt(s.key, secret)
+	if err != nil {
+		return nil, fmt.Errorf("problem decrypting TOTP secret for userId=%s: %v", userId, err)
+	}
+	return &totpEnrollment{
+		secret:    string(bs),
+		confirmed: confirmed,
+	}, nil
+}
+
+func (s *sqliteMFARepository) writeTOTP(userId string, secret string, confirmed bool) error {
+	secret, err := encrypt(s.key, []byte(secret))
+	if err != nil {
+		return err
+	}
+
+	stmt, err := s.db.Prepare(`insert into user_totp (user_id, secret, confirmed) values (?, ?, ?)
+on conflict (user_id) do update set secret = excluded.secret, confirmed = excluded.confirmed`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId, secret, confirmed)
+	return err
+}
+
+func (s *sqliteMFARepository) deleteTOTP(userId string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"user_totp", "user_recovery_codes"} {
+		if _, err := tx.Exec(fmt.Sprintf(`delete from %s where user_id = ?`, table), userId); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem deleting %s userId=%s, err=%v, rollback err=%v", table, userId, err, e)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteMFARepository) useTOTPStep(userId string, step int64) (bool, error) {
+	stmt, err := s.db.Prepare(`update user_totp set last_used_step = ? where user_id = ? and (last_used_step is null or last_used_step < ?)`)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(step, userId, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqliteMFARepository) writeMFAChallenge(userId string, token string, validUntil time.Time) error {
+	token, err := hash(token)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := s.db.Prepare(`insert into user_mfa_challenges (token, user_id, attempts, valid_until) values (?, ?, 0, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(token, userId, validUntil.Format(serializedTimestampFormat))
+	return err
+}
+
+func (s *sqliteMFARepository) findMFAChallenge(token string) (string, error) {
+	token, err := hash(token)
+	if err != nil {
+		return "", err
+	}
+
+	query := `update user_mfa_challenges set attempts = attempts + 1 where token = ? and valid_until > ? and attempts < ?`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(token, time.Now().Format(serializedTimestampFormat), mfaChallengeAttempts)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", nil
+	}
+
+	stmt, err = s.db.Prepare(`select user_id from user_mfa_challenges where token = ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	var userId string
+	if err := stmt.QueryRow(token).Scan(&userId); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return userId, nil
+}
+
+func (s *sqliteMFARepository) deleteMFAChallenge(token string) error {
+	token, err := hash(token)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := s.db.Prepare(`delete from user_mfa_challenges where token = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(token)
+	return err
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// secondFactorRequest holds either a TOTP code or one of the user's recovery codes.
+type secondFactorRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type mfaLoginRequest struct {
+	MFAToken string `json:"mfaToken"`
+	secondFactorRequest
+}
+
+func addMFARoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, mfaService mfaRepository) {
+	router.Methods("POST").Path("/users/mfa/totp").HandlerFunc(enrollTOTPRoute(logger, auth, userService, mfaService))
+	router.Methods("POST").Path("/users/mfa/totp/confirm").HandlerFunc(confirmTOTPRoute(logger, auth, mfaService))
+	router.Methods("DELETE").Path("/users/mfa/totp").HandlerFunc(disableTOTPRoute(logger, auth, mfaService))
+	router.Methods("POST").Path("/users/login/mfa").HandlerFunc(mfaLoginRoute(logger, auth, userService, mfaService))
+}
+
+// enrollTOTPRoute generates a new TOTP secret for the logged in user. The secret isn't
+// required at login until it's confirmed with confirmTOTPRoute.
+func enrollTOTPRoute(logger log.Logger, auth authable, userService userRepository, mfaService mfaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		existing, err := mfaService.getTOTP(userId)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		if existing != nil && existing.confirmed {
+			encodeError(w, errors.New("TOTP is already enabled"))
+			return
+		}
+
+		u, err := userService.lookupByUserId(userId)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		secret, err := generateTOTPSecret()
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		if err := mfaService.writeTOTP(userId, secret, false); err != nil {
+			if err == errEncryptionNotConfigured {
+				encodeError(w, errors.New("TOTP is not available"))
+				return
+			}
+			internalError(w, err, "mfa")
+			return
+		}
+
+		type response struct {
+			Secret string `json:"secret"`
+			URI    string `json:"uri"`
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(&response{secret, totpURI(Domain, u.Email, secret)}); err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+	}
+}
+
+// confirmTOTPRoute enables TOTP for the logged in user once they prove their
+// authenticator app has the secret. A new set of recovery codes is returned.
+func confirmTOTPRoute(logger log.Logger, auth authable, mfaService mfaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		var req totpCodeRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		enrollment, err := mfaService.getTOTP(userId)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		if enrollment == nil || enrollment.confirmed {
+			encodeError(w, errors.New("no pending TOTP enrollment"))
+			return
+		}
+		if ok, err := checkTOTP(userId, enrollment, req.Code, mfaService); err != nil {
+			internalError(w, err, "mfa")
+			return
+		} else if !ok {
+			encodeError(w, errors.New("invalid TOTP code"))
+			return
+		}
+		if err := mfaService.writeTOTP(userId, enrollment.secret, true); err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		logger.Log("mfa", fmt.Sprintf("userId=%s enabled TOTP", userId))
+		writeRecoveryCodes(w, userId, mfaService)
+	}
+}
+
+// disableTOTPRoute removes TOTP from the logged in user after checking a TOTP code or
+// recovery code. This lets users who lost their device re-enroll.
+func disableTOTPRoute(logger log.Logger, auth authable, mfaService mfaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		var req secondFactorRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		enrollment, err := mfaService.getTOTP(userId)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		if enrollment == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if _, ok, err := checkSecondFactor(userId, enrollment, req, mfaService); err != nil {
+			internalError(w, err, "mfa")
+			return
+		} else if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := mfaService.deleteTOTP(userId); err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		logger.Log("mfa", fmt.Sprintf("userId=%s disabled TOTP", userId))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// mfaLoginRoute finishes a login started by loginRoute for users with a second factor.
+func mfaLoginRoute(logger log.Logger, auth authable, userService userRepository, mfaService mfaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+		var req mfaLoginRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		userId, err := mfaService.findMFAChallenge(req.MFAToken)
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+		if userId == "" {
+			authFailures.With("method", "totp").Add(1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		enrollment, err := mfaService.getTOTP(userId)
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+		if enrollment == nil || !enrollment.confirmed {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		method, ok, err := checkSecondFactor(userId, enrollment, req.secondFactorRequest, mfaService)
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+		if !ok {
+			authFailures.With("method", method).Add(1)
+			logger.Log("login", fmt.Sprintf("userId=%s failed %s check", userId, method))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := mfaService.deleteMFAChallenge(req.MFAToken); err != nil {
+			internalError(w, err, "login")
+			return
+		}
+
+		u, err := userService.lookupByUserId(userId)
+		if err != nil {
+			internalError(w, err, "login")
+			return
+		}
+		completeLogin(w, r, u, auth, method)
+	}
+}
+
+// checkSecondFactor validates the TOTP or recovery code in req. The method used
+// ("totp" or "recovery_code") is returned for metrics.
+func checkSecondFactor(userId string, enrollment *totpEnrollment, req secondFactorRequest, mfaService mfaRepository) (string, bool, error) {
+	if req.RecoveryCode != "" {
+		ok, err := mfaService.consumeRecoveryCode(userId, req.RecoveryCode)
+		return "recovery_code", ok, err
+	}
+	ok, err := checkTOTP(userId, enrollment, req.Code, mfaService)
+	return "totp", ok, err
+}
+
+// checkTOTP validates code for the user and rejects codes which have already been used.
+func checkTOTP(userId string, enrollment *totpEnrollment, code string, mfaService mfaRepository) (bool, error) {
+	step, ok := validateTOTP(enrollment.secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return mfaService.useTOTPStep(userId, step)
+}
+
+// startMFAChallenge creates a pending login for the user which is finished
+// with their second factor at mfaLoginRoute.
+func startMFAChallenge(w http.ResponseWriter, userId string, mfaService mfaRepository) {
+	token := generateID()
+	if token == "" {
+		internalError(w, errors.New("problem generating mfaToken"), "login")
+		return
+	}
+	if err := mfaService.writeMFAChallenge(userId, token, time.Now().Add(mfaChallengeTTL)); err != nil {
+		internalError(w, err, "login")
+		return
+	}
+
+	type response struct {
+		MFARequired bool   `json:"mfaRequired"`
+		MFAToken    string `json:"mfaToken"`
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(&response{true, token}); err != nil {
+		internalError(w, err, "login")
+		return
+	}
+}
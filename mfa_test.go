@@ -0,0 +1,241 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestMFA__totpLogin(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+	mfaService := &sqliteMFARepository{db.db, log.NewNopLogger(), key}
+
+	u := &User{ID: generateID(), Email: "test@moov.io", CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := authService.writePassword(u.ID, "password"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addLoginRoutes(router, log.NewNopLogger(), authService, userService, mfaService, &testMailer{})
+	addMFARoutes(router, log.NewNopLogger(), authService, userService, mfaService)
+
+	// enroll
+	req := httptest.NewRequest("POST", "/users/mfa/totp", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/") {
+		t.Errorf("got %s", enrollment.URI)
+	}
+
+	// unconfirmed TOTP isn't required at login
+	login := `{"email": "test@moov.io", "password": "password"}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login", strings.NewReader(login)))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// confirm
+	step := totpStep(time.Now())
+	code, _ := totpCode(enrollment.Secret, step)
+	req = httptest.NewRequest("POST", "/users/mfa/totp/confirm", strings.NewReader(`{"code": "`+code+`"}`))
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	var recovery struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&recovery); err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes", len(recovery.RecoveryCodes))
+	}
+
+	// login now requires a second factor
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login", strings.NewReader(login)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d", w.Code)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("expected no cookie before second factor")
+	}
+	var challenge struct {
+		MFAToken string `json:"mfaToken"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	// replaying the confirmation code is rejected
+	body := `{"mfaToken": "` + challenge.MFAToken + `", "code": "` + code + `"}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login/mfa", strings.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// the next code works
+	code, _ = totpCode(enrollment.Secret, step+1)
+	body = `{"mfaToken": "` + challenge.MFAToken + `", "code": "` + code + `"}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login/mfa", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies", len(cookies))
+	}
+	if userId, _ := authService.findUserId(cookies[0].Value); userId != u.ID {
+		t.Errorf("got userId=%q", userId)
+	}
+
+	// mfaToken is single use
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login/mfa", strings.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestMFA__challengeAttempts(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	mfaService := &sqliteMFARepository{db.db, log.NewNopLogger(), nil}
+	if err := mfaService.writeMFAChallenge("userId", "token", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < mfaChallengeAttempts; i++ {
+		if userId, err := mfaService.findMFAChallenge("token"); userId != "userId" || err != nil {
+			t.Fatalf("attempt %d: got userId=%q, err=%v", i, userId, err)
+		}
+	}
+	if userId, err := mfaService.findMFAChallenge("token"); userId != "" || err != nil {
+		t.Errorf("got userId=%q, err=%v", userId, err)
+	}
+}
+
+func TestMFA__recoveryCodeLogin(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+	mfaService := &sqliteMFARepository{db.db, log.NewNopLogger(), key}
+
+	u := &User{ID: generateID(), Email: "test@moov.io", CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := authService.writePassword(u.ID, "password"); err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := generateTOTPSecret()
+	if err := mfaService.writeTOTP(u.ID, secret, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfaService.writeRecoveryCodes(u.ID, []string{"aaaaa-aaaaa"}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addLoginRoutes(router, log.NewNopLogger(), authService, userService, mfaService, &testMailer{})
+	addMFARoutes(router, log.NewNopLogger(), authService, userService, mfaService)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login", strings.NewReader(`{"email": "test@moov.io", "password": "password"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d", w.Code)
+	}
+	var challenge struct {
+		MFAToken string `json:"mfaToken"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"mfaToken": "` + challenge.MFAToken + `", "recoveryCode": "aaaaa-aaaaa"}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login/mfa", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies", len(cookies))
+	}
+
+	// disable TOTP (i.e. lost device) needs another factor
+	req := httptest.NewRequest("DELETE", "/users/mfa/totp", strings.NewReader(`{"recoveryCode": "aaaaa-aaaaa"}`))
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	code, _ := totpCode(secret, totpStep(time.Now()))
+	req = httptest.NewRequest("DELETE", "/users/mfa/totp", strings.NewReader(`{"code": "`+code+`"}`))
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if enrollment, _ := mfaService.getTOTP(u.ID); enrollment != nil {
+		t.Error("expected TOTP to be removed")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// migration is one version of our schema. up (and down, if the migration can be
+// reverted) can hold several statements separated by semicolons.
+type migration struct {
+	up   string
+	down string
+}
+
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(m.up))
+	return hex.EncodeToString(sum[:])
+}
+
+// appliedMigration is a row of schema_migrations.
+type appliedMigration struct {
+	version   int
+	checksum  string
+	appliedAt time.Time
+}
+
+// migrate brings the database up to date with our migrations (defined in sqlite.go and
+// postgres.go). Each migration is applied in a transaction and recorded in schema_migrations.
+//
+// An error is returned if the database has migrations this binary doesn't know about
+// (i.e. after rolling back a deploy) or if an applied migration has been changed.
+//
+// To configure which database is used set DATABASE_URL, see openDatabase.
+//
+// https://github.com/mattn/go-sqlite3/blob/master/_example/simple/simple.go
+// https://astaxie.gitbooks.io/build-web-application-with-golang/en/05.3.html
+func migrate(db *sql.DB, logger log.Logger) error {
+	return migrateUp(db, logger, migrationsFor(db))
+}
+
+// migrationsFor returns the migrations written for db's dialect.
+func migrationsFor(db *sql.DB) []migration {
+	if dialectOf(db) == postgresDialect {
+		return postgresMigrations
+	}
+	return migrations
+}
+
+func migrateUp(db *sql.DB, logger log.Logger, migrations []migration) error {
+	logger.Log(string(dialectOf(db)), "starting migrations")
+	applied, err := checkMigrations(db, migrations)
+	if err != nil {
+		return err
+	}
+	for i := len(applied); i < len(migrations); i++ {
+		if err := applyMigration(db, i+1, migrations[i].up, true, migrations[i].checksum()); err != nil {
+			return err
+		}
+		logger.Log(string(dialectOf(db)), fmt.Sprintf("applied migration #%d", i+1))
+	}
+	logger.Log(string(dialectOf(db)), "finished migrations")
+	return nil
+}
+
+// migrateDown reverts the latest steps migrations, newest first.
+func migrateDown(db *sql.DB, logger log.Logger, migrations []migration, steps int) error {
+	applied, err := checkMigrations(db, migrations)
+	if err != nil {
+		return err
+	}
+	if steps > len(applied) {
+		return fmt.Errorf("only %d migrations are applied", len(applied))
+	}
+	for i := len(applied); i > len(applied)-steps; i-- {
+		m := migrations[i-1]
+		if m.down == "" {
+			return fmt.Errorf("migration #%d can't be reverted", i)
+		}
+		if err := applyMigration(db, i, m.down, false, ""); err != nil {
+			return err
+		}
+		logger.Log(string(dialectOf(db)), fmt.Sprintf("reverted migration #%d", i))
+	}
+	return nil
+}
+
+// applyMigration runs query and records (or removes, when reverting) version in
+// schema_migrations within the same transaction.
+//
+// Postgres databases can be shared by several instances starting at once, so
+// schema_migrations is locked first and a migration another instance has already
+// applied is skipped.
+func applyMigration(db *sql.DB, version int, query string, up bool, checksum string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if up && dialectOf(db) == postgresDialect {
+		var n int
+		if _, err := tx.Exec(`lock table schema_migrations in share row exclusive mode`); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem locking schema_migrations, err=%v, rollback err=%v", err, e)
+		}
+		if err := tx.QueryRow(`select count(*) from schema_migrations where version = ?`, version).Scan(&n); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem reading migration #%d, err=%v, rollback err=%v", version, err, e)
+		}
+		if n > 0 {
+			return tx.Rollback()
+		}
+	}
+	if _, err := tx.Exec(query); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("migration #%d had problem: %v, rollback err=%v", version, err, e)
+	}
+	if up {
+		_, err = tx.Exec(`insert into schema_migrations (version, checksum, applied_at) values (?, ?, ?)`, version, checksum, time.Now().Format(serializedTimestampFormat))
+	} else {
+		_, err = tx.Exec(`delete from schema_migrations where version = ?`, version)
+	}
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem recording migration #%d, err=%v, rollback err=%v", version, err, e)
+	}
+	return tx.Commit()
+}
+
+// checkMigrations returns the applied migrations, which must be the first of ours and
+// unchanged since they were applied.
+func checkMigrations(db *sql.DB, migrations []migration) ([]*appliedMigration, error) {
+	applied, err := readAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range applied {
+		if m.version > len(migrations) {
+			return nil, fmt.Errorf("database has migration #%d but we only know %d migrations, is this binary out of date?", m.version, len(migrations))
+		}
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration #%d is missing from the database", i+1)
+		}
+		if m.checksum != migrations[i].checksum() {
+			return nil, fmt.Errorf("migration #%d has changed since it was applied", m.version)
+		}
+	}
+	return applied, nil
+}
+
+func readAppliedMigrations(db *sql.DB) ([]*appliedMigration, error) {
+	if _, err := db.Exec(`create table if not exists schema_migrations(version integer primary key, checksum text, applied_at text);`); err != nil {
+		return nil, fmt.Errorf("problem creating schema_migrations: %v", err)
+	}
+	rows, err := db.Query(`select version, checksum, applied_at from schema_migrations order by version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []*appliedMigration
+	for rows.Next() {
+		var m appliedMigration
+		var appliedAt string
+		if err := rows.Scan(&m.version, &m.checksum, &appliedAt); err != nil {
+			return nil, err
+		}
+		if m.appliedAt, err = time.Parse(serializedTimestampFormat, appliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, &m)
+	}
+	return applied, rows.Err()
+}
+
+// migrateCommand runs 'auth migrate status|up|down [steps]' and writes its output to w.
+func migrateCommand(w io.Writer, db *sql.DB, logger log.Logger, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: auth migrate status|up|down [steps]")
+	}
+	migrations := migrationsFor(db)
+	switch args[0] {
+	case "status":
+		applied, err := readAppliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		for i := range migrations {
+			status := "pending"
+			if i < len(applied) && applied[i].version == i+1 {
+				status = "applied " + applied[i].appliedAt.Format(time.RFC3339)
+				if applied[i].checksum != migrations[i].checksum() {
+					status += " (changed since)"
+				}
+			}
+			fmt.Fprintf(w, "#%d\t%s\t%s\n", i+1, status, migrationSummary(migrations[i].up))
+		}
+		for i := range applied {
+			if applied[i].version > len(migrations) {
+				fmt.Fprintf(w, "#%d\tapplied %s\tunknown to this binary\n", applied[i].version, applied[i].appliedAt.Format(time.RFC3339))
+			}
+		}
+		return nil
+
+	case "up":
+		return migrateUp(db, logger, migrations)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid steps %q", args[1])
+			}
+			steps = n
+		}
+		return migrateDown(db, logger, migrations, steps)
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
+
+// migrationSummary returns the start of a migration's first statement.
+func migrationSummary(query string) string {
+	if i := strings.IndexAny(query, ";\n"); i > 0 {
+		query = query[:i]
+	}
+	if len(query) > 60 {
+		query = query[:60] + "..."
+	}
+	return query
+}
@@ -5,63 +5,126 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
-
-	"github.com/moov-io/auth/pkg/buntdbclient"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/gorilla/mux"
+	"gopkg.in/oauth2.v3"
 	"gopkg.in/oauth2.v3/errors"
 	"gopkg.in/oauth2.v3/manage"
 	"gopkg.in/oauth2.v3/models"
 	"gopkg.in/oauth2.v3/server"
-	"gopkg.in/oauth2.v3/store"
 )
 
 type oauth struct {
 	manager     *manage.Manager
-	clientStore *buntdbclient.ClientStore
+	clientStore clientStore
+	tokenStore  *tokenFamilyStore
+	tokens      *sqliteTokenStore
 	server      *server.Server
 
+	// grants are the clients users have authorized
+	grants grantRepository
+
+	// clientSecretGracePeriod is how long a client's secret keeps working after it's rotated
+	clientSecretGracePeriod time.Duration
+
+	// keys is set when JWT access tokens are enabled
+	keys *keyManager
+
+	// introspectionClients can introspect tokens issued to other clients (i.e. resource
+	// servers), from OAUTH2_INTROSPECTION_CLIENTS
+	introspectionClients map[string]bool
+
 	logger log.Logger
 }
 
-func setupOauthServer(logger log.Logger) (*oauth, error) {
+func setupOauthServer(logger log.Logger, db *sql.DB, encryptionKey []byte) (*oauth, error) {
 	out := &oauth{
+		grants: &sqliteGrantRepository{db, logger},
+		tokens: &sqliteTokenStore{db, logger},
 		logger: logger,
 	}
 
-	// oauth2 setup
-	path := os.Getenv("OAUTH2_TOKENS_DB_PATH")
-	if path == "" {
-		path = "oauth2_tokens.db"
+	accessTTL, err := readTokenTTL("OAUTH2_ACCESS_TOKEN_TTL", defaultAccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	refreshTTL, err := readTokenTTL("OAUTH2_REFRESH_TOKEN_TTL", defaultRefreshTokenTTL)
+	if err != nil {
+		return nil, err
 	}
-	tokenStore, err := store.NewFileTokenStore(path)
+	out.clientSecretGracePeriod, err = readTokenTTL("OAUTH2_CLIENT_SECRET_GRACE_PERIOD", defaultClientSecretGracePeriod)
 	if err != nil {
-		return nil, fmt.Errorf("problem creating token store: %v", err)
+		return nil, err
+	}
+	out.introspectionClients = make(map[string]bool)
+	for _, id := range strings.Split(os.Getenv("OAUTH2_INTROSPECTION_CLIENTS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			out.introspectionClients[id] = true
+		}
+	}
+
+	// oauth2 setup
+	out.tokenStore = &tokenFamilyStore{
+		TokenStore: out.tokens,
+		grants:     out.grants,
+		db:         db,
+		log:        logger,
 	}
 
 	out.manager = manage.NewDefaultManager()
-	out.manager.MapTokenStorage(tokenStore)
+	out.manager.MapTokenStorage(out.tokenStore)
+	out.manager.SetValidateURIHandler(validateRedirectURI)
 
-	path = os.Getenv("OAUTH2_CLIENTS_DB_PATH")
-	if path == "" {
-		path = "oauth2_clients.db"
+	// Issue refresh tokens alongside access tokens. Refresh tokens are rotated on each
+	// use, the old access and refresh tokens are removed.
+	cfg := &manage.Config{
+		AccessTokenExp:    accessTTL,
+		RefreshTokenExp:   refreshTTL,
+		IsGenerateRefresh: true,
 	}
-	cs, err := buntdbclient.New(path)
+	out.manager.SetAuthorizeCodeTokenCfg(cfg)
+	out.manager.SetPasswordTokenCfg(cfg)
+	out.manager.SetClientTokenCfg(cfg)
+	out.manager.SetRefreshTokenCfg(&manage.RefreshingConfig{
+		AccessTokenExp:     accessTTL,
+		RefreshTokenExp:    refreshTTL,
+		IsGenerateRefresh:  true,
+		IsResetRefreshTime: true,
+		IsRemoveAccess:     true,
+		IsRemoveRefreshing: true,
+	})
+
+	out.keys, err = setupKeyManager(logger, db, encryptionKey, accessTTL)
 	if err != nil {
-		return nil, fmt.Errorf("problem creating clients store: %v", err)
+		return nil, fmt.Errorf("problem setting up signing keys: %v", err)
+	}
+	if out.keys != nil {
+		logger.Log("oauth", fmt.Sprintf("issuing %s JWT access tokens", out.keys.method.Alg()))
+		out.manager.MapAccessGenerate(&jwtAccessGenerate{out.keys})
+		go out.keys.run()
+	}
+
+	out.clientStore, err = setupClientStore(logger, db)
+	if err != nil {
+		return nil, err
 	}
-	out.clientStore = cs
 	out.manager.MapClientStorage(out.clientStore)
 
 	out.server = server.NewDefaultServer(out.manager)
 	out.server.SetAllowGetAccessRequest(true)
-	out.server.SetClientInfoHandler(server.ClientFormHandler)
+	out.server.SetAllowedResponseType(oauth2.Code)
+	out.server.SetClientInfoHandler(out.clientInfoHandler)
+	out.server.SetClientAuthorizedHandler(out.clientAuthorizedHandler)
+	out.server.SetClientScopeHandler(out.clientScopeHandler)
+	out.server.SetRefreshingScopeHandler(refreshingScopeHandler)
 	out.server.SetInternalErrorHandler(func(err error) (re *errors.Response) {
 		logger.Log("internal-error", err.Error())
 		return
@@ -78,22 +141,31 @@ func setupOauthServer(logger log.Logger) (*oauth, error) {
 }
 
 // addOAuthRoutes includes our oauth2 routes on the provided mux.Router
-func addOAuthRoutes(r *mux.Router, o *oauth, logger log.Logger, auth authable) {
-	r.Methods("GET").Path("/authorize").HandlerFunc(o.authorizeHandler)
+func addOAuthRoutes(r *mux.Router, o *oauth, logger log.Logger, auth authable, userService userRepository) {
+	r.Methods("GET").Path("/authorize").HandlerFunc(o.authorizeHandler(auth, userService))
+	r.Methods("POST").Path("/authorize").HandlerFunc(o.consentHandler(auth, userService))
 	if o.server.Config.AllowGetAccessRequest {
-		r.Methods("GET").Path("/token").HandlerFunc(o.tokenHandler)
+		r.Methods("GET").Path("/token").HandlerFunc(o.tokenHandler(userService))
 	} else {
 		// some oauth implementations need POST
-		r.Methods("POST").Path("/token").HandlerFunc(o.tokenHandler)
+		r.Methods("POST").Path("/token").HandlerFunc(o.tokenHandler(userService))
 	}
-	r.Methods("POST").Path("/token/create").HandlerFunc(o.recreateTokenHandler(auth))
+	r.Methods("GET").Path("/token/check").HandlerFunc(o.checkTokenHandler)
+	r.Methods("POST").Path("/token/create").HandlerFunc(o.recreateTokenHandler(auth, userService))
+	r.Methods("POST").Path("/revoke").HandlerFunc(o.revokeHandler)
+	r.Methods("POST").Path("/introspect").HandlerFunc(o.introspectHandler)
+	r.Methods("GET").Path("/oauth2/clients").HandlerFunc(o.listClientsHandler(auth, userService))
+	r.Methods("POST").Path("/oauth2/clients").HandlerFunc(o.createClientHandler(auth, userService))
+	r.Methods("DELETE").Path("/oauth2/clients/{id}").HandlerFunc(o.deleteClientHandler(auth, userService))
+	r.Methods("POST").Path("/oauth2/clients/{id}/rotate").HandlerFunc(o.rotateClientHandler(auth, userService))
+	r.Methods("GET").Path("/.well-known/jwks.json").HandlerFunc(o.jwksHandler)
+	r.Methods("GET").Path("/.well-known/openid-configuration").HandlerFunc(o.discoveryHandler)
+	r.Methods("GET").Path("/userinfo").HandlerFunc(o.userinfoHandler(userService))
 }
 
-// authorizeHandler checks the request for appropriate oauth information
+// checkTokenHandler checks the request for appropriate oauth information
 // and returns "200 OK" if the token is valid.
-func (o *oauth) authorizeHandler(w http.ResponseWriter, r *http.Request) {
-	// We aren't using HandleAuthorizeRequest here because that assumes redirect_uri
-	// exists on the request. We're just checking for a valid token.
+func (o *oauth) checkTokenHandler(w http.ResponseWriter, r *http.Request) {
 	ti, err := o.server.ValidationBearerToken(r)
 	if err != nil {
 		authFailures.With("method", "oauth2").Add(1)
@@ -113,39 +185,162 @@ func (o *oauth) authorizeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // tokenHandler passes off the request down to our oauth2 library to
-// generate a token (or return an error).e
-func (o *oauth) tokenHandler(w http.ResponseWriter, r *http.Request) {
-	err := o.server.HandleTokenRequest(w, r)
+// generate a token (or return an error).
+//
+// This is HandleTokenRequest split apart so we can check PKCE code verifiers, check
+// refresh tokens for reuse, track the refresh tokens we issue and add OpenID Connect
+// id_tokens.
+func (o *oauth) tokenHandler(userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gt, tgr, err := o.server.ValidationTokenRequest(r)
+		if err != nil {
+			o.tokenError(w, err)
+			return
+		}
+
+		var familyId string
+		var codeReq *codeRequest
+		if gt == oauth2.AuthorizationCode {
+			codeReq, err = o.checkCodeVerifier(tgr, r.FormValue("code_verifier"))
+			if err != nil {
+				authFailures.With("method", "oauth2").Add(1)
+				o.tokenError(w, err)
+				return
+			}
+		}
+		if gt == oauth2.Refreshing {
+			familyId, err = o.checkRefreshToken(tgr)
+			if err != nil {
+				authFailures.With("method", "oauth2").Add(1)
+				o.tokenError(w, err)
+				return
+			}
+		}
+
+		ti, err := o.server.GetAccessToken(gt, tgr)
+		if err != nil {
+			o.tokenError(w, err)
+			return
+		}
+		if ti.GetRefresh() != "" {
+			if familyId == "" {
+				familyId = generateID()
+			}
+			if err := o.tokenStore.recordRefreshToken(familyId, ti); err != nil {
+				o.tokenError(w, err)
+				return
+			}
+		}
+
+		data := o.server.GetTokenData(ti)
+		if err := o.addIDToken(data, ti, codeReq, userService); err != nil {
+			o.tokenError(w, err)
+			return
+		}
+
+		tokenGenerations.With("method", "oauth2").Add(1)
+		writeTokenResponse(w, data, nil, http.StatusOK)
+	}
+}
+
+func (o *oauth) tokenError(w http.ResponseWriter, err error) {
+	data, status, header := o.server.GetErrorData(err)
+	writeTokenResponse(w, data, header, status)
+}
+
+// writeTokenResponse writes data as JSON with the headers RFC 6749 section 5.1 requires.
+func writeTokenResponse(w http.ResponseWriter, data map[string]interface{}, header http.Header, status int) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	for key := range header {
+		w.Header().Set(key, header.Get(key))
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// authenticateClient checks the client credentials on r, which can be sent with
+// HTTP Basic auth or as client_id and client_secret form values. Public clients
+// have no secret to authenticate with.
+func (o *oauth) authenticateClient(r *http.Request) (oauth2.ClientInfo, error) {
+	clientId, clientSecret, err := server.ClientBasicHandler(r)
 	if err != nil {
-		encodeError(w, err)
-		return
+		if err := r.ParseForm(); err != nil {
+			return nil, errors.ErrInvalidRequest
+		}
+		clientId, clientSecret, err = server.ClientFormHandler(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cli, err := o.manager.GetClient(clientId)
+	if err != nil || cli == nil || isPublicClient(cli) {
+		return nil, errors.ErrInvalidClient
 	}
-	// TODO(adam): We need to track this metric inside our TokenStorage.
-	// HandleTokenRequest currently returns nil even if the token request
-	// failed. There's no real way to inspect the http.ResponseWriter in
-	// an attempt to correctly calculate this.
-	// tokenGenerations.With("method", "oauth2").Add(1)
+	if !verifyClientSecret(cli, clientSecret) {
+		return nil, errors.ErrInvalidClient
+	}
+	return cli, nil
+}
+
+// refreshingScopeHandler only allows refreshed tokens to narrow their scope.
+func refreshingScopeHandler(newScope, oldScope string) (bool, error) {
+	old := make(map[string]bool)
+	for _, s := range strings.Fields(oldScope) {
+		old[s] = true
+	}
+	for _, s := range strings.Fields(newScope) {
+		if !old[s] {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
 // recreateTokenHandler will recreate the oauth token for a user. This involves:
 //  - invalidate all existing tokens
 //  - creates new tokens (and returns them only once)
 //
-// This method extracts the user from the cookies in r.
-func (o *oauth) recreateTokenHandler(auth authable) http.HandlerFunc {
+// Named clients from POST /oauth2/clients are left alone, they're rotated
+// individually.
+//
+// This method extracts the user from the cookies in r. Users who haven't
+// verified their email address are rejected.
+func (o *oauth) recreateTokenHandler(auth authable, userService userRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userId, err := auth.findUserId(extractCookie(r).Value)
-		if err != nil {
+		cookie := extractCookie(r)
+		if cookie == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		userId, err := auth.findUserId(cookie.Value)
+		if err != nil || userId == "" {
 			// user not found, return
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+		u, err := userService.lookupByUserId(userId)
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+		if u == nil || !u.Verified {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 
-		records, err := o.clientStore.GetByUserID(userId)
+		var records []oauth2.ClientInfo
+		all, err := o.clientStore.GetByUserID(userId)
 		if err != nil && !strings.Contains(err.Error(), "not found") {
 			internalError(w, err, "oauth")
 			return
 		}
+		for i := range all {
+			if isLegacyClient(all[i]) {
+				records = append(records, all[i])
+			}
+		}
 		if len(records) == 0 { // nothing found, so fake one
 			records = append(records, &models.Client{})
 		}
@@ -186,8 +381,30 @@ func (o *oauth) recreateTokenHandler(auth authable) http.HandlerFunc {
 	}
 }
 
+// deleteUserClients removes every oauth client owned by userId and their tokens.
+func (o *oauth) deleteUserClients(userId string) error {
+	records, err := o.clientStore.GetByUserID(userId)
+	if err != nil && !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	for i := range records {
+		err := o.clientStore.DeleteByID(records[i].GetID())
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			return err
+		}
+		if _, err := o.tokens.removeByClient(records[i].GetID()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (o *oauth) shutdown() error {
-	if o == nil || o.clientStore == nil {
+	if o == nil {
+		return nil
+	}
+	o.keys.shutdown()
+	if o.clientStore == nil {
 		return nil
 	}
 	return o.clientStore.Close()
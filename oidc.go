@@ -0,0 +1,215 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/oauth2.v3"
+	oauth2errors "gopkg.in/oauth2.v3/errors"
+)
+
+var (
+	// oidcScopes are the OpenID Connect scopes we understand. Other scopes are
+	// passed through to access tokens untouched.
+	oidcScopes = []string{"openid", "profile", "email", "phone"}
+
+	errUserNotFound = errors.New("user not found")
+)
+
+// hasScope returns true if scope (space separated) contains want.
+func hasScope(scope string, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupSubject returns the user for sub. lookupByUserId doesn't return an error
+// for unknown users, so check we found something.
+func lookupSubject(userService userRepository, sub string) (*User, error) {
+	if sub == "" {
+		return nil, errUserNotFound
+	}
+	u, err := userService.lookupByUserId(sub)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || u.Email == "" {
+		return nil, errUserNotFound
+	}
+	return u, nil
+}
+
+// idTokenClaims are the claims in an OpenID Connect id_token.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+type idTokenClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	AuthTime      int64  `json:"auth_time,omitempty"`
+	jwt.StandardClaims
+}
+
+// idToken returns a signed id_token for the user of ti, which must have been issued
+// to a user (i.e. not from client_credentials). The token is valid as long
+// as the access token issued alongside it. codeReq is the authorization request of
+// an authorization_code grant, and nil for other grants.
+func (o *oauth) idToken(ti oauth2.TokenInfo, codeReq *codeRequest, userService userRepository) (string, error) {
+	u, err := lookupSubject(userService, ti.GetUserID())
+	if err != nil {
+		return "", err
+	}
+	key, err := o.keys.active()
+	if err != nil {
+		return "", err
+	}
+
+	claims := &idTokenClaims{
+		Email:         u.Email,
+		EmailVerified: u.Verified,
+		Name:          fullName(u),
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    BaseURL,
+			Subject:   u.ID,
+			Audience:  ti.GetClientID(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn()).Unix(),
+		},
+	}
+	if codeReq != nil {
+		claims.Nonce = codeReq.nonce
+		if !codeReq.authTime.IsZero() {
+			claims.AuthTime = codeReq.authTime.Unix()
+		}
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.key)
+}
+
+func fullName(u *User) string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s", u.FirstName, u.LastName))
+}
+
+// userinfoHandler returns claims about the user of a bearer token, filtered by the
+// scopes the token was granted. Tokens need the openid scope and must have been
+// issued to a user, authenticating a client doesn't authenticate its owner.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+func (o *oauth) userinfoHandler(userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ti, err := o.server.ValidationBearerToken(r)
+		if err != nil || !hasScope(ti.GetScope(), "openid") {
+			authFailures.With("method", "oauth2").Add(1)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		u, err := lookupSubject(userService, ti.GetUserID())
+		if err == errUserNotFound {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+
+		claims := map[string]interface{}{
+			"sub": u.ID,
+		}
+		scope := ti.GetScope()
+		if hasScope(scope, "profile") {
+			claims["name"] = fullName(u)
+			claims["given_name"] = u.FirstName
+			claims["family_name"] = u.LastName
+			claims["website"] = u.CompanyURL
+		}
+		if hasScope(scope, "email") {
+			claims["email"] = u.Email
+			claims["email_verified"] = u.Verified
+		}
+		if hasScope(scope, "phone") {
+			claims["phone_number"] = u.Phone
+		}
+
+		authSuccesses.With("method", "oauth2").Add(1)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(claims); err != nil {
+			internalError(w, err, "oauth")
+			return
+		}
+	}
+}
+
+// discoveryHandler serves the OpenID Connect discovery document. OpenID Connect
+// needs signed id_tokens, so it's only available when JWT signing is enabled.
+//
+// https://openid.net/specs/openid-connect-discovery-1_0.html
+func (o *oauth) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if o.keys == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	doc := map[string]interface{}{
+		"issuer":                                BaseURL,
+		"authorization_endpoint":                BaseURL + "/authorize",
+		"token_endpoint":                        BaseURL + "/token",
+		"userinfo_endpoint":                     BaseURL + "/userinfo",
+		"jwks_uri":                              BaseURL + "/.well-known/jwks.json",
+		"revocation_endpoint":                   BaseURL + "/revoke",
+		"introspection_endpoint":                BaseURL + "/introspect",
+		"scopes_supported":                      oidcScopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "client_credentials", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{o.keys.method.Alg()},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"name", "given_name", "family_name", "website",
+			"email", "email_verified", "phone_number",
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		internalError(w, err, "oauth")
+		return
+	}
+}
+
+// addIDToken adds an id_token to token response data when the openid scope was granted.
+func (o *oauth) addIDToken(data map[string]interface{}, ti oauth2.TokenInfo, codeReq *codeRequest, userService userRepository) error {
+	if o.keys == nil || !hasScope(ti.GetScope(), "openid") {
+		return nil
+	}
+	idToken, err := o.idToken(ti, codeReq, userService)
+	if err == errUserNotFound {
+		// i.e. client_credentials, authenticating a client doesn't authenticate a user
+		return oauth2errors.ErrInvalidScope
+	}
+	if err != nil {
+		return err
+	}
+	data["id_token"] = idToken
+	return nil
+}
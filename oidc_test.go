@@ -0,0 +1,332 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestOIDC__hasScope(t *testing.T) {
+	if !hasScope("openid email", "email") {
+		t.Error("expected email scope")
+	}
+	if hasScope("openid emails", "email") || hasScope("", "openid") {
+		t.Error("unexpected scope")
+	}
+}
+
+func TestOIDC__discovery(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&oauth{}).discoveryHandler(w, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d without signing keys", w.Code)
+	}
+
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	os.Setenv("OAUTH2_JWT_SIGNING_ALGORITHM", "RS256")
+	defer os.Unsetenv("OAUTH2_JWT_SIGNING_ALGORITHM")
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	w = httptest.NewRecorder()
+	o.discoveryHandler(w, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	w.Flush()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	var doc struct {
+		Issuer  string   `json:"issuer"`
+		JWKSURI string   `json:"jwks_uri"`
+		Algs    []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Issuer != BaseURL || doc.JWKSURI != BaseURL+"/.well-known/jwks.json" {
+		t.Errorf("%#v", doc)
+	}
+	if len(doc.Algs) != 1 || doc.Algs[0] != "RS256" {
+		t.Errorf("%#v", doc.Algs)
+	}
+}
+
+func TestOIDC__idTokenAndUserinfo(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	os.Setenv("OAUTH2_JWT_SIGNING_ALGORITHM", "ES256")
+	defer os.Unsetenv("OAUTH2_JWT_SIGNING_ALGORITHM")
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+	u := &User{ID: generateID(), Email: "test@moov.io", FirstName: "John", LastName: "Doe", Phone: "555.555.5555", CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	redirectURI := "https://app.moov.io/callback"
+	if err := o.clientStore.Set("client", &models.Client{ID: "client", Secret: "secret", Domain: redirectURI, UserID: u.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.grants.writeGrant(u.ID, "client", "openid email profile phone read"); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenRequest := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/token", nil)
+		r.PostForm = form
+		r.Form = form
+		w := httptest.NewRecorder()
+		o.tokenHandler(userService)(w, r)
+		w.Flush()
+		return w
+	}
+	requestIDToken := func(scope string) (string, string) {
+		// the code /authorize would give the client once the user signs in
+		ti, err := o.manager.GenerateAuthToken(oauth2.Code, &oauth2.TokenGenerateRequest{
+			ClientID:    "client",
+			UserID:      u.ID,
+			RedirectURI: redirectURI,
+			Scope:       scope,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := tokenRequest(url.Values{
+			"grant_type":    []string{"authorization_code"},
+			"client_id":     []string{"client"},
+			"client_secret": []string{"secret"},
+			"code":          []string{ti.GetCode()},
+			"redirect_uri":  []string{redirectURI},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			AccessToken string `json:"access_token"`
+			IDToken     string `json:"id_token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.AccessToken, resp.IDToken
+	}
+
+	// no id_token without openid
+	if _, idToken := requestIDToken("read"); idToken != "" {
+		t.Errorf("unexpected id_token: %s", idToken)
+	}
+
+	access, idToken := requestIDToken("openid email")
+	if idToken == "" {
+		t.Fatal("missing id_token")
+	}
+	var claims idTokenClaims
+	_, err = jwt.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		for _, k := range o.keys.publicKeys() {
+			if k.KeyID == token.Header["kid"] {
+				return k.publicKey(t), nil
+			}
+		}
+		return nil, fmt.Errorf("kid=%v not found", token.Header["kid"])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != u.ID || claims.Audience != "client" || claims.Issuer != BaseURL {
+		t.Errorf("%#v", claims.StandardClaims)
+	}
+	if claims.Email != "test@moov.io" || !claims.EmailVerified || claims.Name != "John Doe" {
+		t.Errorf("%#v", claims)
+	}
+
+	userinfo := func(access string) (int, map[string]interface{}) {
+		r := httptest.NewRequest("GET", "/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+access)
+		w := httptest.NewRecorder()
+		o.userinfoHandler(userService)(w, r)
+		w.Flush()
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var out map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, out
+	}
+
+	// claims are filtered by scope
+	code, info := userinfo(access)
+	if code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if info["sub"] != u.ID || info["email"] != "test@moov.io" || info["email_verified"] != true {
+		t.Errorf("%#v", info)
+	}
+	if _, exists := info["phone_number"]; exists {
+		t.Errorf("unexpected phone_number: %#v", info)
+	}
+	if _, exists := info["name"]; exists {
+		t.Errorf("unexpected name: %#v", info)
+	}
+
+	access, _ = requestIDToken("openid profile phone")
+	_, info = userinfo(access)
+	if info["name"] != "John Doe" || info["phone_number"] != "555.555.5555" {
+		t.Errorf("%#v", info)
+	}
+	if _, exists := info["email"]; exists {
+		t.Errorf("unexpected email: %#v", info)
+	}
+
+	// tokens need the openid scope
+	access, _ = requestIDToken("read")
+	if code, _ := userinfo(access); code != http.StatusUnauthorized {
+		t.Errorf("got %d", code)
+	}
+	if code, _ := userinfo("invalid"); code != http.StatusUnauthorized {
+		t.Errorf("got %d", code)
+	}
+
+	// client_credentials authenticates the client, not its owner
+	w := tokenRequest(url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{"client"},
+		"client_secret": []string{"secret"},
+		"scope":         []string{"openid email"},
+	})
+	if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "id_token") {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	cli, err := o.manager.GetClient("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti, err := o.manager.GenerateAccessToken(oauth2.ClientCredentials, &oauth2.TokenGenerateRequest{
+		ClientID:     "client",
+		ClientSecret: cli.GetSecret(),
+		Scope:        "openid email",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := userinfo(ti.GetAccess()); code != http.StatusUnauthorized {
+		t.Errorf("got %d", code)
+	}
+}
+
+func TestOIDC__idTokenNonce(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	os.Setenv("OAUTH2_JWT_SIGNING_ALGORITHM", "ES256")
+	defer os.Unsetenv("OAUTH2_JWT_SIGNING_ALGORITHM")
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+	u := &User{ID: generateID(), Email: "test@moov.io", Verified: true, CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectURI := "https://app.moov.io/callback"
+	if err := o.clientStore.Set("public", &models.Client{ID: "public", Domain: redirectURI, UserID: u.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, challenge := codeVerifier()
+	params := url.Values{
+		"response_type":         []string{"code"},
+		"client_id":             []string{"public"},
+		"redirect_uri":          []string{redirectURI},
+		"scope":                 []string{"openid email"},
+		"nonce":                 []string{"n-0S6_WzA2Mj"},
+		"code_challenge":        []string{challenge},
+		"code_challenge_method": []string{"S256"},
+	}
+	r := httptest.NewRequest("GET", "/authorize?"+params.Encode(), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	o.authorizeHandler(authService, userService)(w, r)
+	w.Flush()
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusFound {
+		t.Fatalf("got %d: %v", w.Code, err)
+	}
+
+	code, resp := requestToken(t, o, url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"client_id":     []string{"public"},
+		"code":          []string{loc.Query().Get("code")},
+		"redirect_uri":  []string{redirectURI},
+		"code_verifier": []string{verifier},
+	})
+	if code != http.StatusOK || resp.IDToken == "" {
+		t.Fatalf("got %d: %#v", code, resp)
+	}
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		for _, k := range o.keys.publicKeys() {
+			if k.KeyID == token.Header["kid"] {
+				return k.publicKey(t), nil
+			}
+		}
+		return nil, fmt.Errorf("kid=%v not found", token.Header["kid"])
+	}
+	var claims idTokenClaims
+	if _, err := jwt.ParseWithClaims(resp.IDToken, &claims, keyFunc); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Nonce != "n-0S6_WzA2Mj" || claims.Subject != u.ID || claims.Audience != "public" {
+		t.Errorf("%#v", claims)
+	}
+	if authTime := time.Unix(claims.AuthTime, 0); time.Since(authTime) > time.Minute || time.Since(authTime) < -time.Minute {
+		t.Errorf("auth_time=%d", claims.AuthTime)
+	}
+
+	// refreshed id_tokens don't repeat the nonce
+	code, resp = requestToken(t, o, url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"client_id":     []string{"public"},
+		"refresh_token": []string{resp.RefreshToken},
+	})
+	if code != http.StatusOK || resp.IDToken == "" {
+		t.Fatalf("got %d: %#v", code, resp)
+	}
+	claims = idTokenClaims{}
+	if _, err := jwt.ParseWithClaims(resp.IDToken, &claims, keyFunc); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Nonce != "" || claims.AuthTime != 0 {
+		t.Errorf("%#v", claims)
+	}
+}
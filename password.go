@@ -0,0 +1,257 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	passwordResetTTL = 1 * time.Hour
+)
+
+var (
+	// PasswordResetURL is the web page emailed to users who forgot their password,
+	// with the reset token added as token. The page POSTs the token and new password
+	// to /users/password/reset.
+	// If empty BaseURL + "/reset-password" is used.
+	PasswordResetURL string = os.Getenv("PASSWORD_RESET_URL")
+)
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+
+	// RecoveryCode is optional. When it's one of the user's MFA recovery codes
+	// their TOTP enrollment is removed, for users who lost their authenticator.
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+func addPasswordRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, mfaService mfaRepository, mailer mailer) {
+	router.Methods("POST").Path("/users/password/forgot").HandlerFunc(forgotPasswordRoute(logger, auth, userService, mailer))
+	router.Methods("POST").Path("/users/password/reset").HandlerFunc(resetPasswordRoute(logger, auth, mfaService))
+	router.Methods("PUT").Path("/users/password").HandlerFunc(changePasswordRoute(logger, auth))
+}
+
+// changePasswordRoute updates the password of a logged in user after checking their
+// current password. All other sessions for the user are logged out.
+func changePasswordRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "password")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err, "password")
+			return
+		}
+		var req changePasswordRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := auth.checkPassword(userId, req.CurrentPassword); err != nil {
+			authFailures.With("method", "web").Add(1)
+			logger.Log("password", fmt.Sprintf("userId=%s failed current password check: %v", userId, err))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := checkPassword(req.NewPassword); err != nil {
+			encodeError(w, err)
+			return
+		}
+		if err := auth.writePassword(userId, req.NewPassword); err != nil {
+			internalError(w, fmt.Errorf("problem writing user credentials: %v", err), "password")
+			return
+		}
+
+		// Logout every session and issue a new cookie for the current one.
+		if err := auth.invalidateCookies(userId); err != nil {
+			internalError(w, err, "password")
+			return
+		}
+		authInactivations.With("method", "password_change").Add(1)
+		cookie, err := createCookie(userId, r, auth)
+		if err != nil {
+			internalError(w, err, "password")
+			return
+		}
+		http.SetCookie(w, cookie)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// forgotPasswordRoute emails a password reset link to the user if they exist.
+//
+// "200 OK" is always returned (even for unknown emails) to avoid leaking
+// which email addresses have accounts.
+func forgotPasswordRoute(logger log.Logger, auth authable, userService userRepository, mailer mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err, "password")
+			return
+		}
+		var req forgotPasswordRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		u, err := userService.lookupByEmail(req.Email)
+		if err != nil || u == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if err := sendPasswordReset(u, auth, mailer); err != nil {
+			// Don't leak the failure to the caller, it would reveal the user exists.
+			logger.Log("password", fmt.Sprintf("problem sending password reset for userId=%s: %v", u.ID, err))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// sendPasswordReset generates a single-use reset token for u and emails them a link
+// to PasswordResetURL with it.
+func sendPasswordReset(u *User, auth authable, m mailer) error {
+	token := generateID()
+	if token == "" {
+		return errors.New("problem generating password reset token")
+	}
+	if err := auth.writePasswordReset(u.ID, token, time.Now().Add(passwordResetTTL)); err != nil {
+		return err
+	}
+
+	link := passwordResetLink(token)
+	body := fmt.Sprintf("A password reset was requested for your account. Visit the following link to choose a new password:\n\n%s\n\nIf you didn't request this you can ignore this email.\n", link)
+	return m.send(u.Email, "Reset your password", body)
+}
+
+// passwordResetLink returns PasswordResetURL with token added to its query.
+func passwordResetLink(token string) string {
+	page := PasswordResetURL
+	if page == "" {
+		page = BaseURL + "/reset-password"
+	}
+	u, err := url.Parse(page)
+	if err != nil {
+		return fmt.Sprintf("%s?token=%s", page, url.QueryEscape(token))
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// resetPasswordRoute consumes a password reset token and saves the new password.
+// All existing sessions for the user are logged out.
+//
+// A recovery code can be sent along with the token to also remove the user's TOTP
+// enrollment, so they can login and enroll again. If the recovery code doesn't match
+// nothing is changed, but the reset token is still used up so codes can't be guessed
+// without requesting another reset email.
+func resetPasswordRoute(logger log.Logger, auth authable, mfaService mfaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err, "password")
+			return
+		}
+		var req resetPasswordRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" {
+			encodeError(w, errors.New("missing password reset token"))
+			return
+		}
+		// check the new password before consuming the token so it can be retried
+		if err := checkPassword(req.Password); err != nil {
+			encodeError(w, err)
+			return
+		}
+
+		userId, err := auth.consumePasswordReset(req.Token)
+		if err != nil {
+			internalError(w, err, "password")
+			return
+		}
+		if userId == "" {
+			encodeError(w, errors.New("password reset token not found or expired"))
+			return
+		}
+
+		if req.RecoveryCode != "" {
+			ok, err := mfaService.consumeRecoveryCode(userId, req.RecoveryCode)
+			if err != nil {
+				internalError(w, err, "password")
+				return
+			}
+			if !ok {
+				authFailures.With("method", "recovery_code").Add(1)
+				logger.Log("password", fmt.Sprintf("userId=%s sent an invalid recovery code with a password reset", userId))
+				encodeError(w, errors.New("invalid recovery code, request another password reset"))
+				return
+			}
+			if err := mfaService.deleteTOTP(userId); err != nil {
+				internalError(w, err, "password")
+				return
+			}
+			logger.Log("password", fmt.Sprintf("userId=%s removed TOTP with a recovery code", userId))
+		}
+
+		if err := auth.writePassword(userId, req.Password); err != nil {
+			internalError(w, fmt.Errorf("problem writing user credentials: %v", err), "password")
+			return
+		}
+		if err := auth.invalidateCookies(userId); err != nil {
+			internalError(w, err, "password")
+			return
+		}
+		authInactivations.With("method", "password_reset").Add(1)
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+var tokenFromLink = regexp.MustCompile(`token=([a-z0-9]+)`)
+
+func TestPassword__forgotUnknownEmail(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+	m := &testMailer{}
+
+	handler := forgotPasswordRoute(log.NewNopLogger(), authService, userService, m)
+	req := httptest.NewRequest("POST", "/users/password/forgot", strings.NewReader(`{"email": "missing@moov.io"}`))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if len(m.bodies) != 0 {
+		t.Errorf("unexpected emails: %v", m.bodies)
+	}
+}
+
+func TestPassword__resetLink(t *testing.T) {
+	if link := passwordResetLink("abc"); link != BaseURL+"/reset-password?token=abc" {
+		t.Errorf("got %q", link)
+	}
+
+	PasswordResetURL = "https://app.moov.io/account/reset?from=email"
+	defer func() { PasswordResetURL = "" }()
+	if link := passwordResetLink("abc"); link != "https://app.moov.io/account/reset?from=email&token=abc" {
+		t.Errorf("got %q", link)
+	}
+}
+
+func TestPassword__reset(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+	m := &testMailer{}
+
+	u := &User{ID: generateID(), Email: "test@moov.io", CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := authService.writePassword(u.ID, "oldpassword"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// request a reset
+	handler := forgotPasswordRoute(log.NewNopLogger(), authService, userService, m)
+	req := httptest.NewRequest("POST", "/users/password/forgot", strings.NewReader(`{"email": "test@moov.io"}`))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	matches := tokenFromLink.FindStringSubmatch(m.bodies[u.Email])
+	if len(matches) != 2 {
+		t.Fatalf("no reset token found in %q", m.bodies[u.Email])
+	}
+
+	// weak passwords don't consume the token
+	handler = resetPasswordRoute(log.NewNopLogger(), authService, &sqliteMFARepository{db.db, log.NewNopLogger(), nil})
+	body := `{"token": "` + matches[1] + `", "password": "short"}`
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/users/password/reset", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// reset password
+	body = `{"token": "` + matches[1] + `", "password": "newpassword"}`
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/users/password/reset", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if err := authService.checkPassword(u.ID, "newpassword"); err != nil {
+		t.Errorf("new password doesn't match: %v", err)
+	}
+	if userId, _ := authService.findUserId(cookie.Value); userId != "" {
+		t.Error("expected cookies to be invalidated")
+	}
+
+	// tokens are single use
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/users/password/reset", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestPassword__change(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userId := generateID()
+	if err := authService.writePassword(userId, "oldpassword"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(userId, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := changePasswordRoute(log.NewNopLogger(), authService)
+
+	// no cookie
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("PUT", "/users/password", strings.NewReader(`{}`)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// wrong current password
+	req := httptest.NewRequest("PUT", "/users/password", strings.NewReader(`{"currentPassword": "wrong", "newPassword": "newpassword"}`))
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// change password
+	req = httptest.NewRequest("PUT", "/users/password", strings.NewReader(`{"currentPassword": "oldpassword", "newPassword": "newpassword"}`))
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if err := authService.checkPassword(userId, "newpassword"); err != nil {
+		t.Errorf("new password doesn't match: %v", err)
+	}
+	if id, _ := authService.findUserId(cookie.Value); id != "" {
+		t.Error("expected old cookie to be invalidated")
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies", len(cookies))
+	}
+	if id, _ := authService.findUserId(cookies[0].Value); id != userId {
+		t.Errorf("new cookie has userId=%q", id)
+	}
+}
+
+func TestPassword__resetWithRecoveryCode(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	mfaService := &sqliteMFARepository{db.db, log.NewNopLogger(), key}
+
+	userId := generateID()
+	secret, _ := generateTOTPSecret()
+	if err := mfaService.writeTOTP(userId, secret, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfaService.writeRecoveryCodes(userId, []string{"aaaaa-aaaaa", "bbbbb-bbbbb"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := resetPasswordRoute(log.NewNopLogger(), authService, mfaService)
+	reset := func(code string) int {
+		t.Helper()
+		token := generateID()
+		if err := authService.writePasswordReset(userId, token, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		body := `{"token": "` + token + `", "password": "newpassword", "recoveryCode": "` + code + `"}`
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/users/password/reset", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// a wrong code changes nothing
+	if code := reset("ccccc-ccccc"); code != http.StatusBadRequest {
+		t.Errorf("got %d", code)
+	}
+	if err := authService.checkPassword(userId, "newpassword"); err == nil {
+		t.Error("expected password to be unchanged")
+	}
+	if enrollment, _ := mfaService.getTOTP(userId); enrollment == nil {
+		t.Error("expected TOTP enrollment to remain")
+	}
+
+	// a valid code removes TOTP
+	if code := reset("AAAAA AAAAA"); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if err := authService.checkPassword(userId, "newpassword"); err != nil {
+		t.Error(err)
+	}
+	if enrollment, err := mfaService.getTOTP(userId); enrollment != nil || err != nil {
+		t.Errorf("enrollment=%#v err=%v", enrollment, err)
+	}
+	if n, _ := mfaService.countRecoveryCodes(userId); n != 0 {
+		t.Errorf("%d recovery codes left", n)
+	}
+}
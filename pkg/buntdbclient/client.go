@@ -9,13 +9,24 @@
 // GetByUserId. These were needed for ourusecase as we're mutating
 // the oauth clients.
 
+// Each client is stored as a JSON document under "client:<id>", with a
+// "user_id" index over the documents for GetByUserID.
+
+// Client secrets are stored as bcrypt hashes (see oauthclient), so GetSecret() on a
+// stored client returns the hash.
+
 // Tests can be ran with a database in the package dir, just add -debug
 // as a flag to 'go test'.
 // The local database will be deleted before tests are ran each time.
 package buntdbclient
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
+
+	"github.com/moov-io/auth/pkg/oauthclient"
 
 	"github.com/tidwall/buntdb"
 	"gopkg.in/oauth2.v3"
@@ -23,7 +34,8 @@ import (
 )
 
 // New initializes a new BuntDB database with any indicies needed
-// for the Get* operations.
+// for the Get* operations. Clients written by older versions are
+// converted to JSON documents.
 func New(path string) (*ClientStore, error) {
 	db, err := buntdb.Open(path)
 	if err != nil {
@@ -31,9 +43,13 @@ func New(path string) (*ClientStore, error) {
 	}
 
 	err = db.Update(func(tx *buntdb.Tx) error {
-		return tx.CreateIndex("user_id", "*", buntdb.IndexJSON("UserID")) // ScanByUserId
+		if err := tx.CreateIndex("user_id", "client:*", buntdb.IndexJSONCaseSensitive("userId")); err != nil { // GetByUserID
+			return err
+		}
+		return migrateKeys(tx)
 	})
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("problem running migrations: %v", err)
 	}
 
@@ -42,6 +58,151 @@ func New(path string) (*ClientStore, error) {
 	}, nil
 }
 
+// document is how an oauthclient.Client is stored. Registered clients keep their redirect URIs
+// in the client's Domain (space separated), those are stored as RedirectURIs.
+// Anything else in Domain (i.e. a bare domain) is stored as-is.
+type document struct {
+	ID           string   `json:"id"`
+	Secret       string   `json:"secret,omitempty"`
+	Domain       string   `json:"domain,omitempty"`
+	UserID       string   `json:"userId"`
+	Name         string   `json:"name,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+	RedirectURIs []string `json:"redirectUris,omitempty"`
+
+	PreviousSecret          string     `json:"previousSecret,omitempty"`
+	PreviousSecretExpiresAt *time.Time `json:"previousSecretExpiresAt,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func clientKey(id string) string {
+	return "client:" + id
+}
+
+// newDocument returns the document for cli with its secrets hashed. cli isn't modified.
+func newDocument(cli oauth2.ClientInfo) (*document, error) {
+	doc := &document{
+		ID:     cli.GetID(),
+		UserID: cli.GetUserID(),
+	}
+	var err error
+	if doc.Secret, err = oauthclient.HashSecret(cli.GetSecret()); err != nil {
+		return nil, fmt.Errorf("problem hashing secret for %s: %v", doc.ID, err)
+	}
+	domain := strings.Fields(cli.GetDomain())
+	for i := range domain {
+		if !strings.Contains(domain[i], "://") {
+			doc.Domain = cli.GetDomain()
+			domain = nil
+			break
+		}
+	}
+	doc.RedirectURIs = domain
+
+	if c, ok := cli.(*oauthclient.Client); ok {
+		doc.Name = c.Name
+		doc.Scopes = strings.Fields(c.Scope)
+		doc.CreatedAt = c.CreatedAt
+		if c.PreviousSecret != "" {
+			if doc.PreviousSecret, err = oauthclient.HashSecret(c.PreviousSecret); err != nil {
+				return nil, fmt.Errorf("problem hashing previous secret for %s: %v", doc.ID, err)
+			}
+			doc.PreviousSecretExpiresAt = &c.PreviousSecretExpiresAt
+		}
+	}
+	return doc, nil
+}
+
+func (doc *document) client() *oauthclient.Client {
+	cli := &oauthclient.Client{
+		Client: models.Client{
+			ID:     doc.ID,
+			Secret: doc.Secret,
+			Domain: doc.Domain,
+			UserID: doc.UserID,
+		},
+		Name:           doc.Name,
+		Scope:          strings.Join(doc.Scopes, " "),
+		PreviousSecret: doc.PreviousSecret,
+		CreatedAt:      doc.CreatedAt,
+		UpdatedAt:      doc.UpdatedAt,
+	}
+	if len(doc.RedirectURIs) > 0 {
+		cli.Domain = strings.Join(doc.RedirectURIs, " ")
+	}
+	if doc.PreviousSecretExpiresAt != nil {
+		cli.PreviousSecretExpiresAt = *doc.PreviousSecretExpiresAt
+	}
+	return cli
+}
+
+func setDocument(tx *buntdb.Tx, doc *document) error {
+	bs, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, _, err = tx.Set(clientKey(doc.ID), string(bs), nil)
+	return err
+}
+
+// legacyKeys are the suffixes of the keys each client was stored under before
+// clients were JSON documents, i.e. "<id>-secret".
+var legacyKeys = []string{"secret", "domain", "user-id", "name", "scope", "created-at", "previous-secret", "previous-secret-expires-at"}
+
+// migrateKeys converts clients stored as one key per field (with secrets which may
+// not be hashed yet) into documents.
+func migrateKeys(tx *buntdb.Tx) error {
+	var ids []string
+	err := tx.AscendKeys("*-user-id", func(k, v string) bool {
+		ids = append(ids, strings.TrimSuffix(k, "-user-id"))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		values := make(map[string]string)
+		for _, k := range legacyKeys {
+			v, err := tx.Get(fmt.Sprintf("%s-%s", id, k))
+			if err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+			values[k] = v
+		}
+
+		cli := &oauthclient.Client{
+			Client: models.Client{
+				ID:     id,
+				Secret: values["secret"],
+				Domain: values["domain"],
+				UserID: values["user-id"],
+			},
+			Name:           values["name"],
+			Scope:          values["scope"],
+			PreviousSecret: values["previous-secret"],
+		}
+		cli.CreatedAt, _ = time.Parse(time.RFC3339Nano, values["created-at"])
+		cli.PreviousSecretExpiresAt, _ = time.Parse(time.RFC3339Nano, values["previous-secret-expires-at"])
+
+		doc, err := newDocument(cli)
+		if err != nil {
+			return err
+		}
+		doc.UpdatedAt = time.Now()
+		if err := setDocument(tx, doc); err != nil {
+			return err
+		}
+		for _, k := range legacyKeys {
+			if _, err := tx.Delete(fmt.Sprintf("%s-%s", id, k)); err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // ClientStore wraps oauth2.ClientStore
 type ClientStore struct {
 	oauth2.ClientStore
@@ -54,56 +215,40 @@ func (cs *ClientStore) Close() error {
 	return cs.db.Close()
 }
 
-// GetById returns an oauth2.ClientInfo if the ID matches id.
+// GetById returns an oauth2.ClientInfo if the ID matches id. The returned
+// oauth2.ClientInfo is always a *oauthclient.Client.
 func (cs *ClientStore) GetByID(id string) (oauth2.ClientInfo, error) {
-	var cli models.Client
-	cli.ID = id
-
+	var doc document
 	err := cs.db.View(func(tx *buntdb.Tx) error {
-		v, err := tx.Get(fmt.Sprintf("%s-secret", id))
+		v, err := tx.Get(clientKey(id))
 		if err != nil {
 			return err
 		}
-		cli.Secret = v
-
-		v, err = tx.Get(fmt.Sprintf("%s-domain", id))
-		if err != nil {
-			return err
-		}
-		cli.Domain = v
-
-		v, err = tx.Get(fmt.Sprintf("%s-user-id", id))
-		if err != nil {
-			return err
-		}
-		cli.UserID = v
-		return nil
+		return json.Unmarshal([]byte(v), &doc)
 	})
 	if err != nil {
-		var cli models.Client
+		var cli oauthclient.Client
 		return &cli, fmt.Errorf("problem reading %s: %v", id, err)
 	}
-	return &cli, nil
+	return doc.client(), nil
 }
 
-// Set writes the oauth2.ClientInfo to the underlying database.
+// Set writes the oauth2.ClientInfo to the underlying database. Secrets are hashed
+// before they're written, cli isn't modified.
 func (cs *ClientStore) Set(id string, cli oauth2.ClientInfo) error {
 	if inc := cli.GetID(); id != inc {
 		return fmt.Errorf("ClientStore: id's don't match, id=%s and cli=%s", id, inc)
 	}
 
-	err := cs.db.Update(func(tx *buntdb.Tx) error {
-		opts := &buntdb.SetOptions{}
-		_, _, err := tx.Set(fmt.Sprintf("%s-secret", id), cli.GetSecret(), opts)
-		if err != nil {
-			return err
-		}
-		_, _, err = tx.Set(fmt.Sprintf("%s-domain", id), cli.GetDomain(), opts)
-		if err != nil {
-			return err
-		}
-		_, _, err = tx.Set(fmt.Sprintf("%s-user-id", id), cli.GetUserID(), opts)
+	// hash outside of the transaction as bcrypt is slow
+	doc, err := newDocument(cli)
+	if err != nil {
 		return err
+	}
+	doc.UpdatedAt = time.Now()
+
+	err = cs.db.Update(func(tx *buntdb.Tx) error {
+		return setDocument(tx, doc)
 	})
 	if err != nil {
 		return fmt.Errorf("problem updating %s: %v", id, err)
@@ -115,44 +260,60 @@ func (cs *ClientStore) Set(id string, cli oauth2.ClientInfo) error {
 // userId.
 // If return values are nil that means no matching records were found.
 func (cs *ClientStore) GetByUserID(userId string) ([]oauth2.ClientInfo, error) {
-	keys := make(map[string]bool)
-
-	err := cs.db.View(func(tx *buntdb.Tx) error {
-		return tx.AscendEqual("user_id", userId, func(k, v string) bool {
-			if v == userId {
-				keys[k] = true
-			}
-			if k > userId {
-				// quit iterating once we go "past" userId
+	pivot, err := json.Marshal(map[string]string{"userId": userId})
+	if err != nil {
+		return nil, err
+	}
+	var accum []oauth2.ClientInfo
+	err = cs.db.View(func(tx *buntdb.Tx) error {
+		var uerr error
+		err := tx.AscendEqual("user_id", string(pivot), func(k, v string) bool {
+			var doc document
+			if uerr = json.Unmarshal([]byte(v), &doc); uerr != nil {
 				return false
 			}
+			accum = append(accum, doc.client())
 			return true
 		})
+		if err != nil {
+			return err
+		}
+		return uerr
 	})
 	if err != nil {
 		return nil, err
 	}
+	return accum, nil
+}
 
-	// Grab each ClientInfo now
+// List returns every client in the database.
+func (cs *ClientStore) List() ([]oauth2.ClientInfo, error) {
 	var accum []oauth2.ClientInfo
-	for k := range keys {
-		ci, _ := cs.GetByID(k)
-		if ci != nil {
-			accum = append(accum, ci)
+	err := cs.db.View(func(tx *buntdb.Tx) error {
+		var uerr error
+		err := tx.AscendKeys(clientKey("*"), func(k, v string) bool {
+			var doc document
+			if uerr = json.Unmarshal([]byte(v), &doc); uerr != nil {
+				return false
+			}
+			accum = append(accum, doc.client())
+			return true
+		})
+		if err != nil {
+			return err
 		}
-	}
-	if len(accum) == 0 {
-		return nil, nil
+		return uerr
+	})
+	if err != nil {
+		return nil, err
 	}
 	return accum, nil
 }
 
 // DeleteByID removes the oauth2.ClientInfo for the provided id.
 func (cs *ClientStore) DeleteByID(id string) error {
-	return cs.db.Update(func(tx *buntdb.Tx) (e error) {
-		tx.Delete(fmt.Sprintf("%s-secret", id))
-		tx.Delete(fmt.Sprintf("%s-domain", id))
-		_, err := tx.Delete(fmt.Sprintf("%s-user-id", id))
+	return cs.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(clientKey(id))
 		return err
 	})
 }
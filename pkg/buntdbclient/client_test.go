@@ -5,13 +5,19 @@
 package buntdbclient
 
 import (
+	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/moov-io/auth/pkg/oauthclient"
+
+	"github.com/tidwall/buntdb"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/oauth2.v3/models"
 )
 
@@ -19,6 +25,11 @@ var (
 	flagDebug = flag.Bool("debug", false, "Create db inside project dir for tests")
 )
 
+func isHashed(secret string) bool {
+	_, err := bcrypt.Cost([]byte(secret))
+	return err == nil
+}
+
 type testCS struct {
 	*ClientStore
 
@@ -98,7 +109,7 @@ func TestClientStore(t *testing.T) {
 	if cli.GetID() != id {
 		t.Errorf("got %s", cli.GetID())
 	}
-	if cli.GetSecret() != "secret" {
+	if cli.GetSecret() == "secret" || !cli.(*oauthclient.Client).VerifySecret("secret") {
 		t.Errorf("got %s", cli.GetSecret())
 	}
 	if cli.GetDomain() != "domain" {
@@ -162,7 +173,10 @@ func TestClientStore__scan(t *testing.T) {
 		t.Error(err)
 	}
 	if v := len(results); v != 1 {
-		t.Errorf("got %d", v)
+		t.Fatalf("got %d", v)
+	}
+	if results[0].GetID() != id || results[0].GetUserID() != userId {
+		t.Errorf("got %#v", results[0])
 	}
 }
 
@@ -204,3 +218,310 @@ func TestClientStore__delete(t *testing.T) {
 		t.Errorf("got %#v", err)
 	}
 }
+
+func TestClientStore__details(t *testing.T) {
+	cs, err := makeCS(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.cleanup()
+
+	now := time.Now()
+	err = cs.Set("moov", &oauthclient.Client{
+		Client: models.Client{
+			ID:     "moov",
+			Secret: "secret",
+			Domain: "https://moov.io/callback",
+			UserID: "userId",
+		},
+		Name:      "Moov",
+		Scope:     "read write",
+		CreatedAt: now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := cs.GetByID("moov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := cli.(*oauthclient.Client)
+	if !ok {
+		t.Fatalf("got %T", cli)
+	}
+	if c.Name != "Moov" || c.GetScope() != "read write" || !c.CreatedAt.Equal(now) || !c.VerifySecret("secret") {
+		t.Errorf("got %#v", c)
+	}
+
+	// clients without details
+	if err := cs.Set("other", &models.Client{ID: "other", Secret: "secret", UserID: "userId"}); err != nil {
+		t.Fatal(err)
+	}
+	cli, err = cs.GetByID("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := cli.(*oauthclient.Client); c.Name != "" || c.Scope != "" || !c.CreatedAt.IsZero() {
+		t.Errorf("got %#v", c)
+	}
+
+	// details are deleted too
+	if err := cs.DeleteByID("moov"); err != nil {
+		t.Fatal(err)
+	}
+	err = cs.db.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get("client:moov")
+		return err
+	})
+	if err != buntdb.ErrNotFound {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestClientStore__rotateSecret(t *testing.T) {
+	cs, err := makeCS(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.cleanup()
+
+	cli := &oauthclient.Client{Client: models.Client{ID: "moov", Secret: "first", UserID: "userId"}}
+	if !cli.VerifySecret("first") || cli.VerifySecret("") {
+		t.Fatal("unexpected VerifySecret result")
+	}
+
+	// the previous secret works during its grace period
+	cli.RotateSecret("second", time.Now().Add(time.Hour))
+	if err := cs.Set("moov", cli); err != nil {
+		t.Fatal(err)
+	}
+	found, err := cs.GetByID("moov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := found.(*oauthclient.Client)
+	if !c.VerifySecret("second") || !c.VerifySecret("first") || c.VerifySecret("") {
+		t.Errorf("got %#v", c)
+	}
+
+	// and not after
+	c.RotateSecret("third", time.Now().Add(-time.Second))
+	if c.VerifySecret("second") || c.VerifySecret("first") || !c.VerifySecret("third") {
+		t.Errorf("got %#v", c)
+	}
+}
+
+func TestClientStore__hashedSecrets(t *testing.T) {
+	cs, err := makeCS(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.cleanup()
+
+	cli := &oauthclient.Client{Client: models.Client{ID: "moov", Secret: "secret", UserID: "userId"}}
+	if err := cs.Set("moov", cli); err != nil {
+		t.Fatal(err)
+	}
+	if cli.GetSecret() != "secret" {
+		t.Errorf("Set modified client: %#v", cli)
+	}
+	err = cs.db.View(func(tx *buntdb.Tx) error {
+		v, err := tx.Get("client:moov")
+		if err != nil {
+			return err
+		}
+		var doc document
+		if err := json.Unmarshal([]byte(v), &doc); err != nil {
+			return err
+		}
+		if doc.Secret == "secret" || !isHashed(doc.Secret) || strings.Contains(v, `:"secret"`) {
+			t.Errorf("secret stored as %s", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// public clients have no secret to hash
+	if err := cs.Set("public", &models.Client{ID: "public", UserID: "userId"}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := cs.GetByID("public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := found.(*oauthclient.Client); c.GetSecret() != "" || !c.VerifySecret("") || c.VerifySecret("secret") {
+		t.Errorf("got %#v", c)
+	}
+}
+
+func TestClientStore__multipleClients(t *testing.T) {
+	cs, err := makeCS(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.cleanup()
+
+	clients := []*oauthclient.Client{
+		{Client: models.Client{ID: "billing", Secret: "secret", Domain: "https://billing.moov.io/cb https://localhost/cb", UserID: "alice"}, Name: "Billing", Scope: "read"},
+		{Client: models.Client{ID: "payroll", Domain: "https://payroll.moov.io/cb", UserID: "alice"}, Name: "Payroll"},
+		{Client: models.Client{ID: "token", Secret: "secret", Domain: "moov.io", UserID: "alice"}},
+		{Client: models.Client{ID: "other", Secret: "secret", Domain: "moov.io", UserID: "ALICE"}},
+	}
+	for i := range clients {
+		if err := cs.Set(clients[i].ID, clients[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// writing a client again replaces it
+	clients[0].Name = "Invoices"
+	if err := cs.Set("billing", clients[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := cs.GetByUserID("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]*oauthclient.Client)
+	for i := range results {
+		found[results[i].GetID()] = results[i].(*oauthclient.Client)
+	}
+	if len(results) != 3 || len(found) != 3 {
+		t.Fatalf("got %#v", results)
+	}
+	if c := found["billing"]; c.Name != "Invoices" || c.GetDomain() != clients[0].Domain || c.GetScope() != "read" || c.UpdatedAt.IsZero() {
+		t.Errorf("got %#v", c)
+	}
+	if c := found["payroll"]; c.GetSecret() != "" || c.GetDomain() != "https://payroll.moov.io/cb" {
+		t.Errorf("got %#v", c)
+	}
+	if c := found["token"]; c.GetDomain() != "moov.io" || !c.VerifySecret("secret") {
+		t.Errorf("got %#v", c)
+	}
+	if results, err := cs.GetByUserID("ALICE"); err != nil || len(results) != 1 || results[0].GetID() != "other" {
+		t.Errorf("results=%#v err=%v", results, err)
+	}
+
+	// redirect URIs are stored as a list
+	err = cs.db.View(func(tx *buntdb.Tx) error {
+		v, err := tx.Get("client:billing")
+		if err != nil {
+			return err
+		}
+		var doc document
+		if err := json.Unmarshal([]byte(v), &doc); err != nil {
+			return err
+		}
+		if len(doc.RedirectURIs) != 2 || doc.Domain != "" || len(doc.Scopes) != 1 {
+			t.Errorf("got %s", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// delete one
+	if err := cs.DeleteByID("payroll"); err != nil {
+		t.Fatal(err)
+	}
+	if results, err := cs.GetByUserID("alice"); err != nil || len(results) != 2 {
+		t.Errorf("results=%#v err=%v", results, err)
+	}
+	if all, err := cs.List(); err != nil || len(all) != 3 {
+		t.Errorf("all=%#v err=%v", all, err)
+	}
+}
+
+func TestClientStore__migrateKeys(t *testing.T) {
+	cs, err := makeCS(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.cleanup()
+
+	// write clients like older versions did, one key per field and plaintext secrets
+	createdAt := time.Now().Add(-time.Hour)
+	expires := time.Now().Add(time.Hour).Format(time.RFC3339Nano)
+	err = cs.db.Update(func(tx *buntdb.Tx) error {
+		values := map[string]string{
+			"moov-secret":                     "second",
+			"moov-domain":                     "moov.io",
+			"moov-user-id":                    "userId",
+			"moov-previous-secret":            "first",
+			"moov-previous-secret-expires-at": expires,
+
+			"app-secret":     "",
+			"app-domain":     "https://app.moov.io/cb",
+			"app-user-id":    "userId",
+			"app-name":       "App",
+			"app-scope":      "openid email",
+			"app-created-at": createdAt.Format(time.RFC3339Nano),
+		}
+		for k, v := range values {
+			if _, _, err := tx.Set(k, v, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen, twice to check hashes aren't hashed again
+	filename := "client_test.db"
+	if cs.dir != "" {
+		filename = filepath.Join(cs.dir, filename)
+	}
+	for i := 0; i < 2; i++ {
+		if err := cs.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cs.ClientStore, err = New(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// old keys are gone
+	err = cs.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("*", func(k, v string) bool {
+			if !strings.HasPrefix(k, "client:") {
+				t.Errorf("found %s", k)
+			}
+			return true
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := cs.GetByID("moov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := found.(*oauthclient.Client)
+	if !isHashed(c.Secret) || !isHashed(c.PreviousSecret) || c.GetDomain() != "moov.io" {
+		t.Errorf("got %#v", c)
+	}
+	if !c.VerifySecret("second") || !c.VerifySecret("first") || c.VerifySecret("third") {
+		t.Errorf("got %#v", c)
+	}
+
+	results, err := cs.GetByUserID("userId")
+	if err != nil || len(results) != 2 {
+		t.Fatalf("results=%#v err=%v", results, err)
+	}
+	found, err = cs.GetByID("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = found.(*oauthclient.Client)
+	if c.Name != "App" || c.GetScope() != "openid email" || c.GetSecret() != "" || !c.CreatedAt.Equal(createdAt) {
+		t.Errorf("got %#v", c)
+	}
+}
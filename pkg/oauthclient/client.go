@@ -0,0 +1,91 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+// oauthclient holds the OAuth2 client type shared by our client stores.
+
+// Client secrets are stored as bcrypt hashes, so GetSecret() on a stored client
+// returns the hash. Use VerifySecret to check a secret.
+package oauthclient
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// Client is an oauth2.ClientInfo along with the details users give their clients.
+// Clients written as a models.Client have none of these details.
+type Client struct {
+	models.Client
+
+	// Name is shown to users when the client asks for access
+	Name string
+
+	// Scope (space separated) limits which scopes the client can request.
+	// Clients without a scope can request any scope.
+	Scope string
+
+	// PreviousSecret is the secret before the last rotation. It keeps working
+	// until PreviousSecretExpiresAt so deployments can switch over.
+	PreviousSecret          string
+	PreviousSecretExpiresAt time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// GetScope returns the scopes the client is allowed to request.
+func (c *Client) GetScope() string {
+	return c.Scope
+}
+
+// VerifySecret returns true if secret is the client's secret, or its previous
+// secret which hasn't expired yet. Clients without a secret (public clients)
+// only match an empty secret.
+func (c *Client) VerifySecret(secret string) bool {
+	if c.Secret == "" {
+		return secret == ""
+	}
+	if compareSecret(c.Secret, secret) {
+		return true
+	}
+	if c.PreviousSecret == "" || !time.Now().Before(c.PreviousSecretExpiresAt) {
+		return false
+	}
+	return compareSecret(c.PreviousSecret, secret)
+}
+
+// compareSecret checks secret against stored, which is a bcrypt hash unless the
+// client hasn't been written yet.
+func compareSecret(stored, secret string) bool {
+	if isHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(secret)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(secret)) == 1
+}
+
+func isHashed(secret string) bool {
+	_, err := bcrypt.Cost([]byte(secret))
+	return err == nil
+}
+
+// HashSecret returns the bcrypt hash of secret, as it's stored. Empty and already
+// hashed secrets are returned as-is.
+func HashSecret(secret string) (string, error) {
+	if secret == "" || isHashed(secret) {
+		return secret, nil
+	}
+	bs, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(bs), err
+}
+
+// RotateSecret replaces the client's secret with secret. The current secret keeps
+// working until expiresAt.
+func (c *Client) RotateSecret(secret string, expiresAt time.Time) {
+	c.PreviousSecret = c.Secret
+	c.PreviousSecretExpiresAt = expiresAt
+	c.Secret = secret
+}
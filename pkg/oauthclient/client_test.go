@@ -0,0 +1,59 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package oauthclient
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestHashSecret(t *testing.T) {
+	hashed, err := HashSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashed == "secret" || !isHashed(hashed) {
+		t.Errorf("got %q", hashed)
+	}
+	// already hashed and empty secrets are left alone
+	for _, secret := range []string{hashed, ""} {
+		if h, err := HashSecret(secret); h != secret || err != nil {
+			t.Errorf("got %q: %v", h, err)
+		}
+	}
+}
+
+func TestClient__verifySecret(t *testing.T) {
+	hashed, err := HashSecret("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"first", hashed} {
+		c := &Client{Client: models.Client{ID: "moov", Secret: secret}}
+		if !c.VerifySecret("first") || c.VerifySecret("") || c.VerifySecret("second") {
+			t.Errorf("secret=%q", secret)
+		}
+	}
+
+	// public clients only match an empty secret
+	c := &Client{Client: models.Client{ID: "public"}}
+	if !c.VerifySecret("") || c.VerifySecret("first") {
+		t.Error("unexpected VerifySecret result for public client")
+	}
+}
+
+func TestClient__rotateSecret(t *testing.T) {
+	c := &Client{Client: models.Client{ID: "moov", Secret: "first"}}
+	c.RotateSecret("second", time.Now().Add(time.Hour))
+	if !c.VerifySecret("second") || !c.VerifySecret("first") {
+		t.Errorf("got %#v", c)
+	}
+	c.RotateSecret("third", time.Now().Add(-time.Second))
+	if c.VerifySecret("second") || !c.VerifySecret("third") {
+		t.Errorf("got %#v", c)
+	}
+}
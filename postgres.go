@@ -0,0 +1,88 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+// postgresMigrations are our migrations (see sqlite.go) for postgres databases. Every
+// sqlite migration has one here at the same position, so a version means the same
+// schema on either database. Timestamps are stored as text in serializedTimestampFormat,
+// like they are in sqlite.
+var postgresMigrations = []migration{
+	// Initial user setup
+	{
+		up: `create table if not exists users(user_id text primary key, email text, clean_email text, created_at text);
+create table if not exists user_approval_codes(user_id text primary key, code text, valid_until text);
+create table if not exists user_details(user_id text primary key, first_name text, last_name text, phone text, company_url text);
+create table if not exists user_passwords(user_id text primary key, password text, salt text);
+create table if not exists user_password_resets(user_id text primary key, token text, valid_until text);`,
+		down: `drop table users; drop table user_approval_codes; drop table user_details; drop table user_passwords; drop table user_password_resets;`,
+	},
+
+	// Multiple sessions per user, keyed by the hashed cookie data.
+	{
+		up: `create table if not exists user_sessions(data text primary key, user_id text, created_at text, last_seen text, user_agent text, ip_address text, valid_until text);
+create index if not exists user_sessions_user_id on user_sessions (user_id);`,
+		down: `drop table user_sessions;`,
+	},
+
+	// Multi-factor auth
+	{
+		up: `create table if not exists user_totp(user_id text primary key, secret text, confirmed boolean, last_used_step bigint);
+create table if not exists user_mfa_challenges(token text primary key, user_id text, attempts integer, valid_until text);
+create table if not exists user_recovery_codes(user_id text, code text);
+create index if not exists user_recovery_codes_user_id on user_recovery_codes (user_id);`,
+		down: `drop table user_totp; drop table user_mfa_challenges; drop table user_recovery_codes;`,
+	},
+
+	// Passwordless login
+	{
+		up:   `create table if not exists user_login_links(user_id text primary key, token text, valid_until text);`,
+		down: `drop table user_login_links;`,
+	},
+
+	// OAuth2 refresh token families, for rotation and reuse detection
+	{
+		up: `create table if not exists oauth2_refresh_tokens(token text primary key, access text, family_id text, client_id text, used integer, revoked integer, created_at text, valid_until text);
+create index if not exists oauth2_refresh_tokens_access on oauth2_refresh_tokens (access);
+create index if not exists oauth2_refresh_tokens_family_id on oauth2_refresh_tokens (family_id);`,
+		down: `drop table oauth2_refresh_tokens;`,
+	},
+
+	// JWT signing keys, private_key is encrypted with ENCRYPTION_KEY
+	{
+		up:   `create table if not exists oauth2_signing_keys(key_id text primary key, algorithm text, private_key text, state text, created_at text, activated_at text, expires_at text);`,
+		down: `drop table oauth2_signing_keys;`,
+	},
+
+	// PKCE code challenges and OpenID Connect nonce and auth_time for authorization codes, code is hashed
+	{
+		up:   `create table if not exists oauth2_code_challenges(code text primary key, code_challenge text, code_challenge_method text, nonce text, auth_time text, valid_until text);`,
+		down: `drop table oauth2_code_challenges;`,
+	},
+
+	// Scopes users have granted to oauth clients
+	{
+		up:   `create table if not exists oauth2_grants(user_id text, client_id text, scope text, created_at text, updated_at text, primary key (user_id, client_id));`,
+		down: `drop table oauth2_grants;`,
+	},
+
+	// OAuth2 authorization codes, access and refresh tokens. code, access and refresh are hashed
+	{
+		up: `create table if not exists oauth2_tokens(id text primary key, client_id text, user_id text, redirect_uri text, scope text, code text, code_created_at text, code_expires_in bigint, access text, access_created_at text, access_expires_in bigint, refresh text, refresh_created_at text, refresh_expires_in bigint, valid_until text);
+create index if not exists oauth2_tokens_code on oauth2_tokens (code);
+create index if not exists oauth2_tokens_access on oauth2_tokens (access);
+create index if not exists oauth2_tokens_refresh on oauth2_tokens (refresh);
+create index if not exists oauth2_tokens_client_id on oauth2_tokens (client_id);
+create index if not exists oauth2_tokens_user_id on oauth2_tokens (user_id);
+create index if not exists oauth2_tokens_valid_until on oauth2_tokens (valid_until);`,
+		down: `drop table oauth2_tokens;`,
+	},
+
+	// OAuth2 clients, when OAUTH2_CLIENTS_STORE=sql. secret and previous_secret are bcrypt hashes
+	{
+		up: `create table if not exists oauth2_clients(id text primary key, secret text, domain text, user_id text, name text, scope text, previous_secret text, previous_secret_expires_at text, created_at text, updated_at text);
+create index if not exists oauth2_clients_user_id on oauth2_clients (user_id);`,
+		down: `drop table oauth2_clients;`,
+	},
+}
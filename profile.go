@@ -0,0 +1,238 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxNameLength = 100
+)
+
+var (
+	phoneNumber = regexp.MustCompile(`^\+?[0-9 ().-]{7,20}$`)
+)
+
+// profileRequest holds the fields a user can update on their profile.
+// nil fields are left unchanged.
+type profileRequest struct {
+	FirstName  *string `json:"firstName"`
+	LastName   *string `json:"lastName"`
+	Phone      *string `json:"phone"`
+	CompanyURL *string `json:"companyUrl"`
+}
+
+func addProfileRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, o *oauth) {
+	router.Methods("GET").Path("/users/me").HandlerFunc(getProfileRoute(logger, auth, userService))
+	router.Methods("PATCH").Path("/users/me").HandlerFunc(updateProfileRoute(logger, auth, userService))
+	router.Methods("DELETE").Path("/users/me").HandlerFunc(deleteProfileRoute(logger, auth, userService, o))
+}
+
+func getProfileRoute(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "profile")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		u, err := userService.lookupByUserId(userId)
+		if err != nil {
+			internalError(w, err, "profile")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(u); err != nil {
+			internalError(w, err, "profile")
+			return
+		}
+	}
+}
+
+func updateProfileRoute(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "profile")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err, "profile")
+			return
+		}
+		var req profileRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			encodeError(w, err)
+			return
+		}
+
+		u, err := userService.lookupByUserId(userId)
+		if err != nil {
+			internalError(w, err, "profile")
+			return
+		}
+		if req.FirstName != nil {
+			u.FirstName = strings.TrimSpace(*req.FirstName)
+		}
+		if req.LastName != nil {
+			u.LastName = strings.TrimSpace(*req.LastName)
+		}
+		if req.Phone != nil {
+			u.Phone = strings.TrimSpace(*req.Phone)
+		}
+		if req.CompanyURL != nil {
+			u.CompanyURL = strings.TrimSpace(*req.CompanyURL)
+		}
+		if err := userService.upsert(u); err != nil {
+			internalError(w, fmt.Errorf("problem updating user: %v", err), "profile")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(u); err != nil {
+			internalError(w, err, "profile")
+			return
+		}
+	}
+}
+
+// deleteProfileRoute removes the user, their credentials and sessions along with
+// every oauth client they own or have authorized.
+func deleteProfileRoute(logger log.Logger, auth authable, userService userRepository, o *oauth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "profile")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// Remove oauth clients first so a failure leaves the user able to retry.
+		if err := o.deleteUserClients(userId); err != nil {
+			internalError(w, fmt.Errorf("problem deleting oauth clients for userId=%s: %v", userId, err), "profile")
+			return
+		}
+		if err := o.grants.deleteGrants(userId); err != nil {
+			internalError(w, fmt.Errorf("problem deleting oauth grants for userId=%s: %v", userId, err), "profile")
+			return
+		}
+		if _, err := o.tokens.removeByUser(userId); err != nil {
+			internalError(w, fmt.Errorf("problem deleting oauth tokens for userId=%s: %v", userId, err), "profile")
+			return
+		}
+		if err := userService.deleteUser(userId); err != nil {
+			internalError(w, err, "profile")
+			return
+		}
+		authInactivations.With("method", "web").Add(1)
+
+		// expire the cookie in the browser
+		http.SetCookie(w, &http.Cookie{
+			Domain:   Domain,
+			Expires:  time.Unix(0, 0),
+			HttpOnly: true,
+			MaxAge:   -1,
+			Name:     cookieName,
+			Path:     "/",
+			Secure:   serveViaTLS,
+		})
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (req profileRequest) validate() error {
+	if req.FirstName != nil {
+		if err := checkName(*req.FirstName); err != nil {
+			return fmt.Errorf("invalid firstName: %v", err)
+		}
+	}
+	if req.LastName != nil {
+		if err := checkName(*req.LastName); err != nil {
+			return fmt.Errorf("invalid lastName: %v", err)
+		}
+	}
+	if req.Phone != nil {
+		if err := checkPhone(*req.Phone); err != nil {
+			return err
+		}
+	}
+	if req.CompanyURL != nil {
+		if err := checkCompanyURL(*req.CompanyURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkName(name string) error {
+	if n := utf8.RuneCountInString(name); n > maxNameLength {
+		return fmt.Errorf("name can be at most %d characters", maxNameLength)
+	}
+	if strings.ContainsAny(name, "\r\n\t") {
+		return errors.New("name contains invalid characters")
+	}
+	return nil
+}
+
+// checkPhone allows empty values (to clear the phone) or loosely formatted
+// phone numbers, i.e. "+1 (555) 555-1234"
+func checkPhone(phone string) error {
+	phone = strings.TrimSpace(phone)
+	if phone == "" {
+		return nil
+	}
+	if !phoneNumber.MatchString(phone) {
+		return errors.New("invalid phone number")
+	}
+	return nil
+}
+
+// checkCompanyURL allows empty values (to clear the url) or absolute http(s) URLs.
+func checkCompanyURL(raw string) error {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid companyUrl: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("companyUrl must be an http or https URL")
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/auth/pkg/buntdbclient"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestProfile__phone(t *testing.T) {
+	cases := []struct {
+		input string
+		valid bool
+	}{
+		{"", true},
+		{"555-555-1234", true},
+		{"+1 (555) 555-1234", true},
+		{"phone", false},
+		{"123", false},
+	}
+	for i := range cases {
+		err := checkPhone(cases[i].input)
+		if cases[i].valid && err == nil {
+			continue // valid
+		}
+		if !cases[i].valid && err != nil {
+			continue // known bad
+		}
+		t.Errorf("input=%q, err=%v", cases[i].input, err)
+	}
+}
+
+func TestProfile__companyURL(t *testing.T) {
+	cases := []struct {
+		input string
+		valid bool
+	}{
+		{"", true},
+		{"https://moov.io", true},
+		{"http://moov.io/about", true},
+		{"moov.io", false},
+		{"javascript:alert(1)", false},
+		{"ftp://moov.io", false},
+	}
+	for i := range cases {
+		err := checkCompanyURL(cases[i].input)
+		if cases[i].valid && err == nil {
+			continue // valid
+		}
+		if !cases[i].valid && err != nil {
+			continue // known bad
+		}
+		t.Errorf("input=%q, err=%v", cases[i].input, err)
+	}
+}
+
+func TestProfile__routes(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	cs, err := buntdbclient.New(filepath.Join(db.dir, "clients.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	o := &oauth{clientStore: cs, grants: &sqliteGrantRepository{db.db, log.NewNopLogger()}, tokens: &sqliteTokenStore{db.db, log.NewNopLogger()}}
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+
+	u := &User{ID: generateID(), Email: "test@moov.io", FirstName: "John", CreatedAt: time.Now()}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := authService.writePassword(u.ID, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Set("client", &models.Client{ID: "client", Secret: "secret", UserID: u.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.grants.writeGrant(u.ID, "other", "openid"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(u.ID, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clients, _ := cs.GetByUserID(u.ID); len(clients) != 1 {
+		t.Fatalf("got %d oauth clients", len(clients))
+	}
+
+	// update profile
+	req := httptest.NewRequest("PATCH", "/users/me", strings.NewReader(`{"lastName": "Doe", "companyUrl": "https://moov.io"}`))
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	updateProfileRoute(log.NewNopLogger(), authService, userService)(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// invalid update
+	req = httptest.NewRequest("PATCH", "/users/me", strings.NewReader(`{"phone": "call me"}`))
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	updateProfileRoute(log.NewNopLogger(), authService, userService)(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// read profile
+	req = httptest.NewRequest("GET", "/users/me", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	getProfileRoute(log.NewNopLogger(), authService, userService)(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	var found User
+	if err := json.NewDecoder(w.Body).Decode(&found); err != nil {
+		t.Fatal(err)
+	}
+	if found.FirstName != "John" || found.LastName != "Doe" || found.CompanyURL != "https://moov.io" {
+		t.Errorf("got %#v", found)
+	}
+
+	// delete profile
+	req = httptest.NewRequest("DELETE", "/users/me", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	deleteProfileRoute(log.NewNopLogger(), authService, userService, o)(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if _, err := userService.lookupByEmail(u.Email); err == nil {
+		t.Error("expected user to be deleted")
+	}
+	if userId, _ := authService.findUserId(cookie.Value); userId != "" {
+		t.Error("expected cookie to be deleted")
+	}
+	if err := authService.checkPassword(u.ID, "password"); err == nil {
+		t.Error("expected password to be deleted")
+	}
+	if _, err := cs.GetByID("client"); err == nil {
+		t.Error("expected oauth client to be deleted")
+	}
+	if grants, _ := o.grants.listGrants(u.ID); len(grants) != 0 {
+		t.Errorf("expected grants to be deleted: %#v", grants)
+	}
+}
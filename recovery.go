@@ -0,0 +1,218 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes a user is given at once
+	recoveryCodeCount = 10
+)
+
+var (
+	recoveryCodeCleaner = strings.NewReplacer("-", "", " ", "")
+)
+
+// generateRecoveryCodes returns a new set of one-time recovery codes,
+// formatted as "xxxxx-xxxxx" for readability.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		id := generateID()
+		if len(id) < 10 {
+			return nil, errors.New("problem generating recovery code")
+		}
+		codes[i] = fmt.Sprintf("%s-%s", id[:5], id[5:10])
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode drops formatting users might add (or remove) from their codes.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(recoveryCodeCleaner.Replace(code))
+}
+
+func (s *sqliteMFARepository) writeRecoveryCodes(userId string, codes []string) error {
+	// hash codes before starting a transaction as bcrypt is slow
+	hashed := make([]string, len(codes))
+	for i := range codes {
+		bs, err := bcrypt.GenerateFromPassword([]byte(normalizeRecoveryCode(codes[i])), bcryptCostFactor)
+		if err != nil {
+			return err
+		}
+		hashed[i] = string(bs)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`delete from user_recovery_codes where user_id = ?`, userId); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem deleting recovery codes userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	for i := range hashed {
+		if _, err := tx.Exec(`insert into user_recovery_codes (user_id, code) values (?, ?)`, userId, hashed[i]); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem writing recovery codes userId=%s, err=%v, rollback err=%v", userId, err, e)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.log.Log("mfa", fmt.Sprintf("userId=%s generated %d recovery codes", userId, len(codes)))
+	return nil
+}
+
+func (s *sqliteMFARepository) consumeRecoveryCode(userId string, code string) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return false, nil
+	}
+
+	stmt, err := s.db.Prepare(`select code from user_recovery_codes where user_id = ?`)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userId)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var match string
+	for rows.Next() {
+		var hashed string
+		if err := rows.Scan(&hashed); err != nil {
+			return false, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hashed), []byte(code)) == nil {
+			match = hashed
+			break
+		}
+	}
+	rows.Close()
+	if match == "" {
+		return false, nil
+	}
+
+	stmt, err = s.db.Prepare(`delete from user_recovery_codes where user_id = ? and code = ?`)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(userId, match)
+	if err != nil {
+		return false, err
+	}
+	// Another request could have used the code between our select and delete.
+	n, err := res.RowsAffected()
+	if err == nil && n == 1 {
+		s.log.Log("mfa", fmt.Sprintf("userId=%s used a recovery code", userId))
+	}
+	return n == 1, err
+}
+
+func (s *sqliteMFARepository) countRecoveryCodes(userId string) (int, error) {
+	stmt, err := s.db.Prepare(`select count(*) from user_recovery_codes where user_id = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var n int
+	if err := stmt.QueryRow(userId).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func addRecoveryCodeRoutes(router *mux.Router, logger log.Logger, auth authable, mfaService mfaRepository) {
+	router.Methods("GET").Path("/users/mfa/recovery-codes").HandlerFunc(countRecoveryCodesRoute(logger, auth, mfaService))
+	router.Methods("POST").Path("/users/mfa/recovery-codes").HandlerFunc(regenerateRecoveryCodesRoute(logger, auth, mfaService))
+}
+
+// countRecoveryCodesRoute returns how many unused recovery codes the logged in user has.
+func countRecoveryCodesRoute(logger log.Logger, auth authable, mfaService mfaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		n, err := mfaService.countRecoveryCodes(userId)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+
+		type response struct {
+			Remaining int `json:"remaining"`
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(&response{n}); err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+	}
+}
+
+// regenerateRecoveryCodesRoute replaces the logged in user's recovery codes. The new
+// codes are only returned this once.
+func regenerateRecoveryCodesRoute(logger log.Logger, auth authable, mfaService mfaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "mfa")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeRecoveryCodes(w, userId, mfaService)
+	}
+}
+
+// writeRecoveryCodes generates and saves a new set of recovery codes for the user
+// and writes them back as JSON.
+func writeRecoveryCodes(w http.ResponseWriter, userId string, mfaService mfaRepository) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		internalError(w, err, "mfa")
+		return
+	}
+	if err := mfaService.writeRecoveryCodes(userId, codes); err != nil {
+		internalError(w, err, "mfa")
+		return
+	}
+
+	type response struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(&response{codes}); err != nil {
+		internalError(w, err, "mfa")
+		return
+	}
+}
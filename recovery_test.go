@@ -0,0 +1,119 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestRecoveryCodes__generate(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("got %d codes", len(codes))
+	}
+	seen := make(map[string]bool)
+	for i := range codes {
+		if len(codes[i]) != 11 || seen[codes[i]] {
+			t.Errorf("unexpected code %q", codes[i])
+		}
+		seen[codes[i]] = true
+	}
+	if v := normalizeRecoveryCode(" ABCDE-12345 "); v != "abcde12345" {
+		t.Errorf("got %q", v)
+	}
+}
+
+func TestRecoveryCodes__consume(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	mfaService := &sqliteMFARepository{db.db, log.NewNopLogger(), nil}
+	if err := mfaService.writeRecoveryCodes("userId", []string{"aaaaa-aaaaa", "bbbbb-bbbbb"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// codes can be entered without formatting, but only once
+	if ok, err := mfaService.consumeRecoveryCode("userId", "AAAAAAAAAA"); !ok || err != nil {
+		t.Errorf("ok=%v, err=%v", ok, err)
+	}
+	if ok, err := mfaService.consumeRecoveryCode("userId", "aaaaa-aaaaa"); ok || err != nil {
+		t.Errorf("ok=%v, err=%v", ok, err)
+	}
+	if ok, _ := mfaService.consumeRecoveryCode("other", "bbbbb-bbbbb"); ok {
+		t.Error("codes belong to a single user")
+	}
+	if n, err := mfaService.countRecoveryCodes("userId"); n != 1 || err != nil {
+		t.Errorf("n=%d, err=%v", n, err)
+	}
+
+	// regenerating replaces the old set
+	if err := mfaService.writeRecoveryCodes("userId", []string{"ccccc-ccccc"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := mfaService.consumeRecoveryCode("userId", "bbbbb-bbbbb"); ok {
+		t.Error("expected old code to be invalid")
+	}
+}
+
+func TestRecoveryCodes__routes(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	mfaService := &sqliteMFARepository{db.db, log.NewNopLogger(), nil}
+	userId := generateID()
+	cookie, err := createCookie(userId, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addRecoveryCodeRoutes(router, log.NewNopLogger(), authService, mfaService)
+
+	req := httptest.NewRequest("POST", "/users/mfa/recovery-codes", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	var codes struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&codes); err != nil {
+		t.Fatal(err)
+	}
+	if len(codes.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("got %d codes", len(codes.RecoveryCodes))
+	}
+	mfaService.consumeRecoveryCode(userId, codes.RecoveryCodes[0])
+
+	req = httptest.NewRequest("GET", "/users/mfa/recovery-codes", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if v := strings.TrimSpace(w.Body.String()); v != `{"remaining":9}` {
+		t.Errorf("got %s", v)
+	}
+}
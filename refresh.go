@@ -0,0 +1,275 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+const (
+	defaultAccessTokenTTL  = 2 * time.Hour
+	defaultRefreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// readTokenTTL parses the duration (i.e. "1h30m") in env var key, or returns def if it's unset.
+func readTokenTTL(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %v", key, d)
+	}
+	return d, nil
+}
+
+// refreshToken is what we track about each refresh token we issue.
+//
+// Every refresh token belongs to a family: the tokens issued from one grant and all
+// of their rotations. Refresh tokens are single use, so if one is presented twice it
+// has leaked and the whole family is revoked.
+type refreshToken struct {
+	familyID string
+	clientID string
+	used     bool
+	revoked  bool
+}
+
+// tokenFamilyStore wraps an oauth2.TokenStore to track refresh token families.
+// Tokens in a revoked family are hidden from the oauth2 library, which then
+// treats them as invalid.
+//
+// Only SHA256 checksums of tokens are stored.
+type tokenFamilyStore struct {
+	oauth2.TokenStore
+
+	// grants hides user tokens once the user revokes the client's grant
+	grants grantRepository
+
+	db  *sql.DB
+	log log.Logger
+}
+
+// GetByAccess returns the token info for access unless its family was revoked.
+func (s *tokenFamilyStore) GetByAccess(access string) (oauth2.TokenInfo, error) {
+	ti, err := s.TokenStore.GetByAccess(access)
+	if err != nil || ti == nil {
+		return ti, err
+	}
+	revoked, err := s.isRevoked(`select count(*) from oauth2_refresh_tokens where access = ? and revoked = 1`, access)
+	if err != nil || revoked {
+		return nil, err
+	}
+	revoked, err = s.grantRevoked(ti, ti.GetAccessCreateAt())
+	if err != nil || revoked {
+		return nil, err
+	}
+	return ti, nil
+}
+
+// GetByRefresh returns the token info for refresh unless its family was revoked.
+func (s *tokenFamilyStore) GetByRefresh(refresh string) (oauth2.TokenInfo, error) {
+	ti, err := s.TokenStore.GetByRefresh(refresh)
+	if err != nil || ti == nil {
+		return ti, err
+	}
+	revoked, err := s.isRevoked(`select count(*) from oauth2_refresh_tokens where token = ? and revoked = 1`, refresh)
+	if err != nil || revoked {
+		return nil, err
+	}
+	revoked, err = s.grantRevoked(ti, ti.GetRefreshCreateAt())
+	if err != nil || revoked {
+		return nil, err
+	}
+	return ti, nil
+}
+
+// grantRevoked returns true for user tokens created before the user's current grant to
+// the client, i.e. the user revoked the client since the token was issued.
+func (s *tokenFamilyStore) grantRevoked(ti oauth2.TokenInfo, createdAt time.Time) (bool, error) {
+	if s.grants == nil || ti.GetUserID() == "" {
+		return false, nil
+	}
+	g, err := s.grants.getGrant(ti.GetUserID(), ti.GetClientID())
+	if err != nil {
+		return false, err
+	}
+	return g == nil || createdAt.Before(g.CreatedAt), nil
+}
+
+func (s *tokenFamilyStore) isRevoked(query string, token string) (bool, error) {
+	token, err := hash(token)
+	if err != nil {
+		return false, err
+	}
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	var n int
+	if err := stmt.QueryRow(token).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// findRefreshToken returns what we know about refresh, or nil if it's not a token we've tracked.
+func (s *tokenFamilyStore) findRefreshToken(refresh string) (*refreshToken, error) {
+	refresh, err := hash(refresh)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := s.db.Prepare(`select family_id, client_id, used, revoked from oauth2_refresh_tokens where token = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var rt refreshToken
+	err = stmt.QueryRow(refresh).Scan(&rt.familyID, &rt.clientID, &rt.used, &rt.revoked)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+// recordRefreshToken adds the refresh token in ti to familyId. Expired refresh tokens
+// are cleaned up at the same time since they can't be used (or reused) anymore.
+func (s *tokenFamilyStore) recordRefreshToken(familyId string, ti oauth2.TokenInfo) error {
+	refresh, err := hash(ti.GetRefresh())
+	if err != nil {
+		return err
+	}
+	access, err := hash(ti.GetAccess())
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	validUntil := ti.GetRefreshCreateAt().Add(ti.GetRefreshExpiresIn())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`delete from oauth2_refresh_tokens where valid_until < ?`, now.Format(serializedTimestampFormat))
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem cleaning up refresh tokens clientId=%s, err=%v, rollback err=%v", ti.GetClientID(), err, e)
+	}
+	query := `insert into oauth2_refresh_tokens (token, access, family_id, client_id, used, revoked, created_at, valid_until) values (?, ?, ?, ?, 0, 0, ?, ?)`
+	_, err = tx.Exec(query, refresh, access, familyId, ti.GetClientID(), now.Format(serializedTimestampFormat), validUntil.Format(serializedTimestampFormat))
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem recording refresh token clientId=%s, err=%v, rollback err=%v", ti.GetClientID(), err, e)
+	}
+	return tx.Commit()
+}
+
+// useRefreshToken marks refresh as used. false is returned if it was already used.
+func (s *tokenFamilyStore) useRefreshToken(refresh string) (bool, error) {
+	refresh, err := hash(refresh)
+	if err != nil {
+		return false, err
+	}
+	stmt, err := s.db.Prepare(`update oauth2_refresh_tokens set used = 1 where token = ? and used = 0 and revoked = 0`)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(refresh)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// revokeFamily revokes every access and refresh token in familyId.
+func (s *tokenFamilyStore) revokeFamily(familyId string) error {
+	stmt, err := s.db.Prepare(`update oauth2_refresh_tokens set revoked = 1 where family_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(familyId)
+	return err
+}
+
+// checkRefreshToken is called before the refresh_token grant is handed to the oauth2
+// library. It returns the family the rotated tokens belong to, or revokes the family
+// if the refresh token has already been used.
+func (o *oauth) checkRefreshToken(tgr *oauth2.TokenGenerateRequest) (string, error) {
+	rt, err := o.tokenStore.findRefreshToken(tgr.Refresh)
+	if err != nil {
+		return "", err
+	}
+	if rt != nil && rt.revoked {
+		return "", errors.ErrInvalidGrant
+	}
+	if rt != nil && rt.used {
+		return "", o.revokeTokenFamily(rt)
+	}
+
+	// Check the client and token before marking the token as used, otherwise anyone
+	// could burn a refresh token (and revoke its family) without the client's secret.
+	cli, err := o.manager.GetClient(tgr.ClientID)
+	if err != nil {
+		return "", err
+	}
+	if cli.GetSecret() != tgr.ClientSecret {
+		return "", errors.ErrInvalidClient
+	}
+	ti, err := o.manager.LoadRefreshToken(tgr.Refresh)
+	if err == errors.ErrInvalidRefreshToken || err == errors.ErrExpiredRefreshToken {
+		return "", errors.ErrInvalidGrant
+	}
+	if err != nil {
+		return "", err
+	}
+	if ti.GetClientID() != tgr.ClientID {
+		return "", errors.ErrInvalidGrant
+	}
+
+	if rt == nil {
+		// Issued before we tracked refresh tokens, so start a new family.
+		return generateID(), nil
+	}
+	ok, err := o.tokenStore.useRefreshToken(tgr.Refresh)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		// Another request used the token between our checks.
+		return "", o.revokeTokenFamily(rt)
+	}
+	return rt.familyID, nil
+}
+
+func (o *oauth) revokeTokenFamily(rt *refreshToken) error {
+	if err := o.tokenStore.revokeFamily(rt.familyID); err != nil {
+		return err
+	}
+	o.logger.Log("oauth", fmt.Sprintf("refresh token reused, revoked token family for clientId=%s", rt.clientID))
+	authInactivations.With("method", "oauth2_refresh_reuse").Add(1)
+	return errors.ErrInvalidGrant
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// createTestOAuth returns an oauth server with its client store in db's temp dir.
+// Callers should defer o.shutdown().
+func createTestOAuth(t *testing.T, db *testSqliteDB) *oauth {
+	t.Helper()
+
+	os.Setenv("OAUTH2_CLIENTS_DB_PATH", filepath.Join(db.dir, "clients.db"))
+	defer os.Unsetenv("OAUTH2_CLIENTS_DB_PATH")
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	o, err := setupOauthServer(log.NewNopLogger(), db.db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.clientStore.Set("client", &models.Client{ID: "client", Secret: "secret", Domain: Domain}); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	IDToken      string `json:"id_token"`
+	Error        string `json:"error"`
+}
+
+func requestToken(t *testing.T, o *oauth, form url.Values) (int, *tokenResponse) {
+	t.Helper()
+
+	r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	o.tokenHandler(&sqliteUserRepository{o.tokenStore.db, log.NewNopLogger()})(w, r)
+	w.Flush()
+
+	if v := w.Header().Get("Cache-Control"); v != "no-store" {
+		t.Errorf("Cache-Control: %q", v)
+	}
+	var resp tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, &resp
+}
+
+func refreshForm(refresh string) url.Values {
+	return url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"client_id":     []string{"client"},
+		"client_secret": []string{"secret"},
+		"refresh_token": []string{refresh},
+	}
+}
+
+func validAccessToken(o *oauth, access string) bool {
+	r := httptest.NewRequest("GET", "/token/check", nil)
+	r.Header.Set("Authorization", "Bearer "+access)
+	_, err := o.server.ValidationBearerToken(r)
+	return err == nil
+}
+
+func TestRefresh__readTokenTTL(t *testing.T) {
+	key := "OAUTH2_TEST_TOKEN_TTL"
+	defer os.Unsetenv(key)
+
+	if d, err := readTokenTTL(key, time.Hour); err != nil || d != time.Hour {
+		t.Errorf("d=%v err=%v", d, err)
+	}
+	os.Setenv(key, "15m")
+	if d, err := readTokenTTL(key, time.Hour); err != nil || d != 15*time.Minute {
+		t.Errorf("d=%v err=%v", d, err)
+	}
+	for _, v := range []string{"15", "-1h", "0s"} {
+		os.Setenv(key, v)
+		if _, err := readTokenTTL(key, time.Hour); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestRefresh__refreshingScopeHandler(t *testing.T) {
+	cases := []struct {
+		newScope, oldScope string
+		allowed            bool
+	}{
+		{"read", "read write", true},
+		{"read write", "write read", true},
+		{"admin", "read write", false},
+		{"read admin", "read", false},
+	}
+	for i := range cases {
+		allowed, err := refreshingScopeHandler(cases[i].newScope, cases[i].oldScope)
+		if err != nil || allowed != cases[i].allowed {
+			t.Errorf("newScope=%q oldScope=%q allowed=%v err=%v", cases[i].newScope, cases[i].oldScope, allowed, err)
+		}
+	}
+}
+
+func TestRefresh__rotation(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	code, first := requestToken(t, o, url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{"client"},
+		"client_secret": []string{"secret"},
+	})
+	if code != http.StatusOK || first.AccessToken == "" || first.RefreshToken == "" {
+		t.Fatalf("got %d: %#v", code, first)
+	}
+
+	code, second := requestToken(t, o, refreshForm(first.RefreshToken))
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %#v", code, second)
+	}
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Errorf("refresh token wasn't rotated: %#v", second)
+	}
+	if validAccessToken(o, first.AccessToken) {
+		t.Error("old access token is still valid")
+	}
+	if !validAccessToken(o, second.AccessToken) {
+		t.Error("new access token is invalid")
+	}
+
+	// wrong client secret doesn't burn the token
+	form := refreshForm(second.RefreshToken)
+	form.Set("client_secret", "wrong")
+	if code, _ := requestToken(t, o, form); code == http.StatusOK {
+		t.Errorf("got %d with wrong client_secret", code)
+	}
+	code, third := requestToken(t, o, refreshForm(second.RefreshToken))
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %#v", code, third)
+	}
+	if !validAccessToken(o, third.AccessToken) {
+		t.Error("access token is invalid")
+	}
+}
+
+func TestRefresh__reuseRevokesFamily(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	form := url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{"client"},
+		"client_secret": []string{"secret"},
+	}
+	_, first := requestToken(t, o, form)
+	_, other := requestToken(t, o, form) // separate family
+	_, second := requestToken(t, o, refreshForm(first.RefreshToken))
+	if second.AccessToken == "" {
+		t.Fatalf("%#v", second)
+	}
+
+	// present the old refresh token again
+	code, resp := requestToken(t, o, refreshForm(first.RefreshToken))
+	if code != http.StatusUnauthorized || resp.Error != "invalid_grant" {
+		t.Errorf("got %d: %#v", code, resp)
+	}
+
+	// everything in the family is revoked
+	if validAccessToken(o, second.AccessToken) {
+		t.Error("access token should be revoked")
+	}
+	if code, resp := requestToken(t, o, refreshForm(second.RefreshToken)); code != http.StatusUnauthorized {
+		t.Errorf("got %d: %#v", code, resp)
+	}
+
+	// other families are untouched
+	if !validAccessToken(o, other.AccessToken) {
+		t.Error("other access token should be valid")
+	}
+	if code, resp := requestToken(t, o, refreshForm(other.RefreshToken)); code != http.StatusOK {
+		t.Errorf("got %d: %#v", code, resp)
+	}
+}
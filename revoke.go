@@ -0,0 +1,104 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+// revokeHandler implements OAuth 2.0 Token Revocation (RFC 7009) for access and
+// refresh tokens. Revoking a refresh token also revokes the access token issued
+// with it and every token rotated from the same grant.
+//
+// "200 OK" is returned for unknown (or already revoked) tokens as the RFC requires,
+// since there's nothing left for the client to do.
+//
+// https://tools.ietf.org/html/rfc7009
+func (o *oauth) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	cli, err := o.authenticateClient(r)
+	if err != nil {
+		o.tokenError(w, err)
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		o.tokenError(w, errors.ErrInvalidRequest)
+		return
+	}
+
+	// token_type_hint only decides which lookup happens first, we fall back to the other.
+	isRefresh := r.PostFormValue("token_type_hint") == "refresh_token"
+	ti, isRefresh, err := o.findToken(token, isRefresh)
+	if err != nil {
+		o.tokenError(w, err)
+		return
+	}
+	if ti == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if ti.GetClientID() != cli.GetID() {
+		// Clients can only revoke their own tokens.
+		o.tokenError(w, errors.ErrUnauthorizedClient)
+		return
+	}
+
+	if isRefresh {
+		err = o.revokeRefreshToken(ti)
+	} else {
+		err = o.tokenStore.RemoveByAccess(ti.GetAccess())
+	}
+	if err != nil {
+		o.tokenError(w, err)
+		return
+	}
+
+	o.logger.Log("oauth", fmt.Sprintf("clientId=%s revoked a token", cli.GetID()))
+	authInactivations.With("method", "oauth2").Add(1)
+	w.WriteHeader(http.StatusOK)
+}
+
+// findToken looks up token as an access or refresh token, trying the hinted type first.
+// The returned bool is true if token was a refresh token.
+func (o *oauth) findToken(token string, refreshFirst bool) (oauth2.TokenInfo, bool, error) {
+	lookups := []bool{refreshFirst, !refreshFirst}
+	for _, isRefresh := range lookups {
+		var ti oauth2.TokenInfo
+		var err error
+		if isRefresh {
+			ti, err = o.tokenStore.GetByRefresh(token)
+		} else {
+			ti, err = o.tokenStore.GetByAccess(token)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if ti != nil {
+			return ti, isRefresh, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// revokeRefreshToken removes the refresh token in ti along with the access token issued
+// with it, which the token store keeps in the same row. The token family is revoked so
+// no other token from the same grant can be used.
+func (o *oauth) revokeRefreshToken(ti oauth2.TokenInfo) error {
+	rt, err := o.tokenStore.findRefreshToken(ti.GetRefresh())
+	if err != nil {
+		return err
+	}
+	if rt != nil {
+		if err := o.tokenStore.revokeFamily(rt.familyID); err != nil {
+			return err
+		}
+	}
+	return o.tokenStore.RemoveByRefresh(ti.GetRefresh())
+}
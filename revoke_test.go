@@ -0,0 +1,114 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func revokeToken(o *oauth, form url.Values, username, password string) int {
+	r := httptest.NewRequest("POST", "/revoke", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if username != "" {
+		r.SetBasicAuth(username, password)
+	}
+	w := httptest.NewRecorder()
+	o.revokeHandler(w, r)
+	w.Flush()
+	return w.Code
+}
+
+func TestRevoke(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	o := createTestOAuth(t, db)
+	defer o.shutdown()
+
+	if err := o.clientStore.Set("other", &models.Client{ID: "other", Secret: "other-secret", Domain: Domain}); err != nil {
+		t.Fatal(err)
+	}
+
+	newToken := func() *tokenResponse {
+		code, resp := requestToken(t, o, url.Values{
+			"grant_type":    []string{"client_credentials"},
+			"client_id":     []string{"client"},
+			"client_secret": []string{"secret"},
+		})
+		if code != http.StatusOK {
+			t.Fatalf("got %d: %#v", code, resp)
+		}
+		return resp
+	}
+
+	// bad client auth
+	tok := newToken()
+	form := url.Values{"token": []string{tok.AccessToken}}
+	if code := revokeToken(o, form, "client", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("got %d", code)
+	}
+	if code := revokeToken(o, form, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("got %d", code)
+	}
+	// another client's token
+	if code := revokeToken(o, form, "other", "other-secret"); code == http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if !validAccessToken(o, tok.AccessToken) {
+		t.Fatal("token was revoked")
+	}
+	// missing token
+	if code := revokeToken(o, url.Values{}, "client", "secret"); code != http.StatusBadRequest {
+		t.Errorf("got %d", code)
+	}
+
+	// access token with form auth
+	form.Set("client_id", "client")
+	form.Set("client_secret", "secret")
+	if code := revokeToken(o, form, "", ""); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if validAccessToken(o, tok.AccessToken) {
+		t.Error("access token wasn't revoked")
+	}
+	// revoking again (or any unknown token) is fine
+	if code := revokeToken(o, form, "", ""); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+
+	// refresh token with HTTP Basic auth, revokes its access token too
+	tok = newToken()
+	form = url.Values{"token": []string{tok.RefreshToken}, "token_type_hint": []string{"refresh_token"}}
+	if code := revokeToken(o, form, "client", "secret"); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if validAccessToken(o, tok.AccessToken) {
+		t.Error("access token wasn't revoked")
+	}
+	if ti, err := o.tokenStore.TokenStore.GetByAccess(tok.AccessToken); ti != nil || err != nil {
+		t.Errorf("access token wasn't removed: %#v err=%v", ti, err)
+	}
+	if code, resp := requestToken(t, o, refreshForm(tok.RefreshToken)); code == http.StatusOK {
+		t.Errorf("refresh token wasn't revoked: %#v", resp)
+	}
+
+	// wrong hint still finds the token
+	tok = newToken()
+	form = url.Values{"token": []string{tok.RefreshToken}, "token_type_hint": []string{"access_token"}}
+	if code := revokeToken(o, form, "client", "secret"); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if validAccessToken(o, tok.AccessToken) {
+		t.Error("access token wasn't revoked")
+	}
+}
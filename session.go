@@ -0,0 +1,148 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// session represents a logged in client (browser, device) of a user.
+type session struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	IPAddress string    `json:"ipAddress"`
+	UserAgent string    `json:"userAgent"`
+
+	// Current is true for the session making the request
+	Current bool `json:"current"`
+}
+
+// sessionID returns the public identifier for a session given its stored (hashed)
+// cookie data. It's safe to expose as the cookie can't be recovered from it.
+func sessionID(data string) string {
+	id, _ := hash(data)
+	if len(id) > 20 {
+		return id[:20]
+	}
+	return id
+}
+
+// findCurrentSession returns the session of r's cookie, or nil if userId doesn't have it.
+func findCurrentSession(r *http.Request, auth authable, userId string) (*session, error) {
+	cookie := extractCookie(r)
+	if cookie == nil {
+		return nil, nil
+	}
+	data, err := hash(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := auth.listSessions(userId)
+	if err != nil {
+		return nil, err
+	}
+	current := sessionID(data)
+	for i := range sessions {
+		if sessions[i].ID == current {
+			sessions[i].Current = true
+			return sessions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func addSessionRoutes(router *mux.Router, logger log.Logger, auth authable) {
+	router.Methods("GET").Path("/users/sessions").HandlerFunc(listSessionsRoute(logger, auth))
+	router.Methods("DELETE").Path("/users/sessions").HandlerFunc(deleteSessionsRoute(logger, auth))
+	router.Methods("DELETE").Path("/users/sessions/{id}").HandlerFunc(deleteSessionRoute(logger, auth))
+}
+
+func listSessionsRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "sessions")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		sessions, err := auth.listSessions(userId)
+		if err != nil {
+			internalError(w, err, "sessions")
+			return
+		}
+		if data, err := hash(extractCookie(r).Value); err == nil {
+			current := sessionID(data)
+			for i := range sessions {
+				sessions[i].Current = sessions[i].ID == current
+			}
+		}
+
+		type response struct {
+			Sessions []*session `json:"sessions"`
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(&response{sessions}); err != nil {
+			internalError(w, err, "sessions")
+			return
+		}
+	}
+}
+
+// deleteSessionsRoute logs the user out of every session, including the current one.
+func deleteSessionsRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "sessions")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := auth.invalidateCookies(userId); err != nil {
+			internalError(w, err, "sessions")
+			return
+		}
+		authInactivations.With("method", "web").Add(1)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func deleteSessionRoute(logger log.Logger, auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := findUserIdFromCookie(r, auth)
+		if err != nil {
+			internalError(w, err, "sessions")
+			return
+		}
+		if userId == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		found, err := auth.invalidateSession(userId, mux.Vars(r)["id"])
+		if err != nil {
+			internalError(w, err, "sessions")
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		authInactivations.With("method", "web").Add(1)
+		w.WriteHeader(http.StatusOK)
+	}
+}
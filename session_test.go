@@ -0,0 +1,119 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestSessions__routes(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userId := generateID()
+
+	laptop, err := createCookie(userId, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, err := createCookie(userId, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addSessionRoutes(router, log.NewNopLogger(), authService)
+	addLogoutRoutes(router, log.NewNopLogger(), authService)
+
+	// list sessions
+	req := httptest.NewRequest("GET", "/users/sessions", nil)
+	req.AddCookie(laptop)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	var resp struct {
+		Sessions []*session `json:"sessions"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Sessions) != 2 {
+		t.Fatalf("got %d sessions", len(resp.Sessions))
+	}
+	var other string
+	for _, s := range resp.Sessions {
+		if s.IPAddress != "192.0.2.1" || s.CreatedAt.IsZero() {
+			t.Errorf("got %#v", s)
+		}
+		if !s.Current {
+			other = s.ID
+		}
+	}
+	if other == "" {
+		t.Fatal("no current session found")
+	}
+
+	// revoke the phone session
+	req = httptest.NewRequest("DELETE", "/users/sessions/"+other, nil)
+	req.AddCookie(laptop)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if id, _ := authService.findUserId(phone.Value); id != "" {
+		t.Error("expected phone session to be revoked")
+	}
+	if id, _ := authService.findUserId(laptop.Value); id != userId {
+		t.Error("expected laptop session to be active")
+	}
+
+	// unknown session
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// logout only removes the current session
+	phone, _ = createCookie(userId, httptest.NewRequest("POST", "/users/login", nil), authService)
+	req = httptest.NewRequest("DELETE", "/users/login", nil)
+	req.AddCookie(laptop)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if id, _ := authService.findUserId(laptop.Value); id != "" {
+		t.Error("expected laptop session to be revoked")
+	}
+	if id, _ := authService.findUserId(phone.Value); id != userId {
+		t.Error("expected phone session to be active")
+	}
+
+	// logout everywhere
+	req = httptest.NewRequest("DELETE", "/users/sessions", nil)
+	req.AddCookie(phone)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if id, _ := authService.findUserId(phone.Value); id != "" {
+		t.Error("expected phone session to be revoked")
+	}
+}
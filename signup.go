@@ -32,11 +32,11 @@ type signupRequest struct {
 	CompanyURL string `json:"companyUrl,omitempty"`
 }
 
-func addSignupRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository) {
-	router.Methods("POST").Path("/users/create").HandlerFunc(signupRoute(auth, userService))
+func addSignupRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, mailer mailer) {
+	router.Methods("POST").Path("/users/create").HandlerFunc(signupRoute(auth, userService, mailer))
 }
 
-func signupRoute(auth authable, userService userRepository) func(w http.ResponseWriter, r *http.Request) {
+func signupRoute(auth authable, userService userRepository, mailer mailer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Body == nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -105,8 +105,11 @@ func signupRoute(auth authable, userService userRepository) func(w http.Response
 				return
 			}
 
-			// signup worked, yay!
-			// TODO(adam): email approval link and clickthrough
+			// signup worked, yay! The user needs to verify their email before logging in.
+			if err := sendApprovalCode(u, userService, mailer); err != nil {
+				internalError(w, fmt.Errorf("problem sending approval code: %v", err), "signup")
+				return
+			}
 		} else {
 			// user found, so reject signup
 			encodeError(w, errors.New("user already exists"))
@@ -13,22 +13,99 @@ import (
 
 	_ "github.com/mattn/go-sqlite3"
 
-	"github.com/go-kit/kit/log"
 	kitprom "github.com/go-kit/kit/metrics/prometheus"
 	stdprom "github.com/prometheus/client_golang/prometheus"
 )
 
 var (
-	// migrations holds all our SQL migrations to be done (in order)
-	migrations = []string{
+	// migrations holds all our SQL migrations to be done (in order). A migration's
+	// version is its position in this list, starting at 1. Never edit or reorder
+	// a migration once it's released, add a new one instead (along with its postgres
+	// version in postgres.go).
+	//
+	// Migrations 1 through 10 were ran on every startup before versions were
+	// tracked, so they're written to be safe against existing databases.
+	migrations = []migration{
 		// Initial user setup
 		//
 		// TODO(adam): be super fancy and generate README.md table in go:generate
-		`create table if not exists users(user_id primary key, email, clean_email, created_at);`,
-		`create table if not exists user_approval_codes (user_id primary key, code, valid_until);`,
-		`create table if not exists user_details(user_id primary key, first_name, last_name, phone, company_url);`,
-		`create table if not exists user_cookies(user_id primary key, data, valid_until);`,
-		`create table if not exists user_passwords(user_id primary key, password, salt);`,
+		{
+			up: `create table if not exists users(user_id primary key, email, clean_email, created_at);
+create table if not exists user_approval_codes (user_id primary key, code, valid_until);
+create table if not exists user_details(user_id primary key, first_name, last_name, phone, company_url);
+create table if not exists user_cookies(user_id primary key, data, valid_until);
+create table if not exists user_passwords(user_id primary key, password, salt);
+create table if not exists user_password_resets(user_id primary key, token, valid_until);`,
+		},
+
+		// Multiple sessions per user, keyed by the hashed cookie data.
+		// Existing cookies are copied over and user_cookies is dropped.
+		{
+			up: `create table if not exists user_sessions(data primary key, user_id, created_at, last_seen, user_agent, ip_address, valid_until);
+create index if not exists user_sessions_user_id on user_sessions (user_id);
+insert or ignore into user_sessions (data, user_id, created_at, last_seen, user_agent, ip_address, valid_until) select data, user_id, '', '', '', '', valid_until from user_cookies;
+drop table if exists user_cookies;`,
+		},
+
+		// Multi-factor auth
+		{
+			up: `create table if not exists user_totp(user_id primary key, secret, confirmed, last_used_step);
+create table if not exists user_mfa_challenges(token primary key, user_id, attempts, valid_until);
+create table if not exists user_recovery_codes(user_id, code);
+create index if not exists user_recovery_codes_user_id on user_recovery_codes (user_id);`,
+			down: `drop table user_totp; drop table user_mfa_challenges; drop table user_recovery_codes;`,
+		},
+
+		// Passwordless login
+		{
+			up:   `create table if not exists user_login_links(user_id primary key, token, valid_until);`,
+			down: `drop table user_login_links;`,
+		},
+
+		// OAuth2 refresh token families, for rotation and reuse detection
+		{
+			up: `create table if not exists oauth2_refresh_tokens(token primary key, access, family_id, client_id, used, revoked, created_at, valid_until);
+create index if not exists oauth2_refresh_tokens_access on oauth2_refresh_tokens (access);
+create index if not exists oauth2_refresh_tokens_family_id on oauth2_refresh_tokens (family_id);`,
+			down: `drop table oauth2_refresh_tokens;`,
+		},
+
+		// JWT signing keys, private_key is encrypted with ENCRYPTION_KEY
+		{
+			up:   `create table if not exists oauth2_signing_keys(key_id primary key, algorithm, private_key, state, created_at, activated_at, expires_at);`,
+			down: `drop table oauth2_signing_keys;`,
+		},
+
+		// PKCE code challenges and OpenID Connect nonce and auth_time for authorization codes, code is hashed
+		{
+			up:   `create table if not exists oauth2_code_challenges(code primary key, code_challenge, code_challenge_method, nonce, auth_time, valid_until);`,
+			down: `drop table oauth2_code_challenges;`,
+		},
+
+		// Scopes users have granted to oauth clients
+		{
+			up:   `create table if not exists oauth2_grants(user_id, client_id, scope, created_at, updated_at, primary key (user_id, client_id));`,
+			down: `drop table oauth2_grants;`,
+		},
+
+		// OAuth2 authorization codes, access and refresh tokens. code, access and refresh are hashed
+		{
+			up: `create table if not exists oauth2_tokens(id primary key, client_id, user_id, redirect_uri, scope, code, code_created_at, code_expires_in, access, access_created_at, access_expires_in, refresh, refresh_created_at, refresh_expires_in, valid_until);
+create index if not exists oauth2_tokens_code on oauth2_tokens (code);
+create index if not exists oauth2_tokens_access on oauth2_tokens (access);
+create index if not exists oauth2_tokens_refresh on oauth2_tokens (refresh);
+create index if not exists oauth2_tokens_client_id on oauth2_tokens (client_id);
+create index if not exists oauth2_tokens_user_id on oauth2_tokens (user_id);
+create index if not exists oauth2_tokens_valid_until on oauth2_tokens (valid_until);`,
+			down: `drop table oauth2_tokens;`,
+		},
+
+		// OAuth2 clients, when OAUTH2_CLIENTS_STORE=sqlite. secret and previous_secret are bcrypt hashes
+		{
+			up: `create table if not exists oauth2_clients(id primary key, secret, domain, user_id, name, scope, previous_secret, previous_secret_expires_at, created_at, updated_at);
+create index if not exists oauth2_clients_user_id on oauth2_clients (user_id);`,
+			down: `drop table oauth2_clients;`,
+		},
 	}
 
 	// Metrics
@@ -83,34 +160,3 @@ func createConnection(path string) (*sql.DB, error) {
 	return db, nil
 }
 
-// migrate runs our database migrations (defined at the top of this file)
-// over a sqlite database it creates first.
-// To configure where on disk the sqlite db is set SQLITE_DB_PATH.
-//
-// You use db like any other database/sql driver.
-//
-// https://github.com/mattn/go-sqlite3/blob/master/_example/simple/simple.go
-// https://astaxie.gitbooks.io/build-web-application-with-golang/en/05.3.html
-func migrate(logger log.Logger) (*sql.DB, error) {
-	path := getSqlitePath()
-	db, err := createConnection(path)
-	if err != nil {
-		return nil, err
-	}
-
-	logger.Log("sqlite", fmt.Sprintf("migrating %s", path))
-	for i := range migrations {
-		row := migrations[i]
-		res, err := db.Exec(row)
-		if err != nil {
-			return nil, fmt.Errorf("migration #%d [%s...] had problem: %v", i, row[:40], err)
-		}
-		n, err := res.RowsAffected()
-		if err == nil {
-			logger.Log("sqlite", fmt.Sprintf("migration #%d [%s...] changed %d rows", i, row[:40], n))
-		}
-	}
-	logger.Log("sqlite", "finished migrations")
-
-	return db, nil
-}
@@ -5,12 +5,58 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
 )
 
+type testSqliteDB struct {
+	db *sql.DB
+
+	// temp dir used
+	dir string
+}
+
+func (r *testSqliteDB) close() error {
+	if r == nil {
+		return nil
+	}
+	err := r.db.Close()
+	if r.dir != "" {
+		os.RemoveAll(r.dir)
+	}
+	return err
+}
+
+// createTestSqliteDB returns a migrated sqlite database inside a temp dir.
+// Callers should defer db.close().
+func createTestSqliteDB() (*testSqliteDB, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	dir, err := ioutil.TempDir("", "auth-sqlite")
+	if err != nil {
+		return nil, err
+	}
+	db, err := createConnection(filepath.Join(dir, "auth.db"))
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db, log.NewNopLogger()); err != nil {
+		return nil, err
+	}
+	return &testSqliteDB{db, dir}, nil
+}
+
 func TestSqlite__basic(t *testing.T) {
 	// setup temp database
 	f, err := ioutil.TempFile("", "auth-sqlite3-test")
@@ -31,3 +77,183 @@ func TestSqlite__basic(t *testing.T) {
 	}
 	res.Close()
 }
+
+func TestSqlite__migrate(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	// migrations are safe to run multiple times
+	if err := migrate(db.db, log.NewNopLogger()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSqlite__migrateUserCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := createConnection(filepath.Join(dir, "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// write a cookie with the old (single session) schema
+	data, _ := hash("cookie")
+	validUntil := time.Now().Add(time.Hour).Format(serializedTimestampFormat)
+	if _, err := db.Exec(`create table user_cookies(user_id primary key, data, valid_until);`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`insert into user_cookies (user_id, data, valid_until) values (?, ?, ?)`, "userId", data, validUntil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrate(db, log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	authService := &auth{db, log.NewNopLogger()}
+	if userId, err := authService.findUserId("cookie"); userId != "userId" || err != nil {
+		t.Errorf("got userId=%q, err=%v", userId, err)
+	}
+}
+
+func TestSqlite__migrationVersions(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	applied, err := readAppliedMigrations(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("got %d applied migrations", len(applied))
+	}
+	for i := range applied {
+		if applied[i].version != i+1 || applied[i].checksum != migrations[i].checksum() || applied[i].appliedAt.IsZero() {
+			t.Errorf("got %#v", applied[i])
+		}
+	}
+
+	// refuse to run against a newer database
+	next := len(migrations) + 1
+	if _, err := db.db.Exec(`insert into schema_migrations (version, checksum, applied_at) values (?, '', ?)`, next, time.Now().Format(serializedTimestampFormat)); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db.db, log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "out of date") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := db.db.Exec(`delete from schema_migrations where version = ?`, next); err != nil {
+		t.Fatal(err)
+	}
+
+	// or one where a migration was edited
+	if _, err := db.db.Exec(`update schema_migrations set checksum = 'other' where version = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db.db, log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSqlite__migrateUpAndDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := createConnection(filepath.Join(dir, "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	steps := []migration{
+		{up: `create table things(id primary key, name);`, down: `drop table things;`},
+		{up: `insert into things (id, name) values ('a', 'Alice'), ('b', 'Bob');`},
+		{
+			up: `alter table things add column clean_name;
+update things set clean_name = lower(name);
+create index things_clean_name on things (clean_name);`,
+			down: `drop index things_clean_name;`,
+		},
+	}
+	if err := migrateUp(db, log.NewNopLogger(), steps); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := db.QueryRow(`select clean_name from things where id = 'a'`).Scan(&name); err != nil || name != "alice" {
+		t.Errorf("name=%q err=%v", name, err)
+	}
+
+	// a failed migration leaves nothing behind
+	broken := append(steps, migration{up: `create table more(id); insert into missing values (1);`})
+	if err := migrateUp(db, log.NewNopLogger(), broken); err == nil {
+		t.Error("expected error")
+	}
+	if err := db.QueryRow(`select count(*) from more`).Scan(new(int)); err == nil {
+		t.Error("expected more to be rolled back")
+	}
+	if applied, _ := readAppliedMigrations(db); len(applied) != 3 {
+		t.Errorf("got %d applied", len(applied))
+	}
+
+	// down
+	if err := migrateDown(db, log.NewNopLogger(), steps, 1); err != nil {
+		t.Fatal(err)
+	}
+	if applied, _ := readAppliedMigrations(db); len(applied) != 2 {
+		t.Errorf("got %d applied", len(applied))
+	}
+	if err := migrateDown(db, log.NewNopLogger(), steps, 1); err == nil || !strings.Contains(err.Error(), "can't be reverted") {
+		t.Errorf("got %v", err)
+	}
+	if err := migrateDown(db, log.NewNopLogger(), steps, 5); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSqlite__migrateCommand(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	var buf bytes.Buffer
+	if err := migrateCommand(&buf, db.db, log.NewNopLogger(), []string{"down"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateCommand(&buf, db.db, log.NewNopLogger(), []string{"status"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(migrations) {
+		t.Fatalf("got %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "applied") || !strings.HasPrefix(lines[len(lines)-1], fmt.Sprintf("#%d\tpending", len(migrations))) {
+		t.Errorf("got %q", buf.String())
+	}
+
+	if err := migrateCommand(&buf, db.db, log.NewNopLogger(), []string{"up"}); err != nil {
+		t.Fatal(err)
+	}
+	if applied, _ := readAppliedMigrations(db.db); len(applied) != len(migrations) {
+		t.Errorf("got %d applied", len(applied))
+	}
+	for _, args := range [][]string{nil, {"sideways"}, {"down", "zero"}} {
+		if err := migrateCommand(&buf, db.db, log.NewNopLogger(), args); err == nil {
+			t.Errorf("%q: expected error", args)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// sqliteTokenStore is an oauth2.TokenStore for the authorization codes, access and refresh
+// tokens we issue. Each row is one issued code, or an access token with its refresh token.
+//
+// Like tokenFamilyStore only SHA256 checksums of codes and tokens are stored, so the
+// oauth2.TokenInfo returned from a lookup only carries the code or token it was found
+// with. Removing a refresh token removes the access token issued with it.
+type sqliteTokenStore struct {
+	db  *sql.DB
+	log log.Logger
+}
+
+// storedToken is what we show about issued tokens, never the tokens themselves.
+type storedToken struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"clientId"`
+	UserID    string    `json:"userId,omitempty"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Create saves ti. Expired codes and tokens are cleaned up at the same time.
+func (s *sqliteTokenStore) Create(ti oauth2.TokenInfo) error {
+	code, err := hashToken(ti.GetCode())
+	if err != nil {
+		return err
+	}
+	access, err := hashToken(ti.GetAccess())
+	if err != nil {
+		return err
+	}
+	refresh, err := hashToken(ti.GetRefresh())
+	if err != nil {
+		return err
+	}
+
+	// Keep the row until whatever it holds expires.
+	var validUntil time.Time
+	if code.Valid {
+		validUntil = ti.GetCodeCreateAt().Add(ti.GetCodeExpiresIn())
+	}
+	if t := ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn()); access.Valid && t.After(validUntil) {
+		validUntil = t
+	}
+	if t := ti.GetRefreshCreateAt().Add(ti.GetRefreshExpiresIn()); refresh.Valid && t.After(validUntil) {
+		validUntil = t
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`delete from oauth2_tokens where valid_until < ?`, time.Now().Format(serializedTimestampFormat))
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem cleaning up tokens clientId=%s, err=%v, rollback err=%v", ti.GetClientID(), err, e)
+	}
+	query := `insert into oauth2_tokens (id, client_id, user_id, redirect_uri, scope, code, code_created_at, code_expires_in, access, access_created_at, access_expires_in, refresh, refresh_created_at, refresh_expires_in, valid_until) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(query, generateID(), ti.GetClientID(), ti.GetUserID(), ti.GetRedirectURI(), ti.GetScope(),
+		code, ti.GetCodeCreateAt().Format(serializedTimestampFormat), int64(ti.GetCodeExpiresIn()),
+		access, ti.GetAccessCreateAt().Format(serializedTimestampFormat), int64(ti.GetAccessExpiresIn()),
+		refresh, ti.GetRefreshCreateAt().Format(serializedTimestampFormat), int64(ti.GetRefreshExpiresIn()),
+		validUntil.Format(serializedTimestampFormat))
+	if err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem saving token clientId=%s, err=%v, rollback err=%v", ti.GetClientID(), err, e)
+	}
+	return tx.Commit()
+}
+
+// RemoveByCode deletes the authorization code.
+func (s *sqliteTokenStore) RemoveByCode(code string) error {
+	return s.remove(`delete from oauth2_tokens where code = ?`, code)
+}
+
+// RemoveByAccess deletes the access token. Its refresh token keeps working.
+func (s *sqliteTokenStore) RemoveByAccess(access string) error {
+	if err := s.remove(`delete from oauth2_tokens where access = ? and refresh is null`, access); err != nil {
+		return err
+	}
+	return s.remove(`update oauth2_tokens set access = null where access = ?`, access)
+}
+
+// RemoveByRefresh deletes the refresh token and the access token issued with it.
+func (s *sqliteTokenStore) RemoveByRefresh(refresh string) error {
+	return s.remove(`delete from oauth2_tokens where refresh = ?`, refresh)
+}
+
+func (s *sqliteTokenStore) remove(query string, token string) error {
+	token, err := hash(token)
+	if err != nil {
+		return err
+	}
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(token)
+	return err
+}
+
+// GetByCode returns the token info for code, or nil if it's not found.
+func (s *sqliteTokenStore) GetByCode(code string) (oauth2.TokenInfo, error) {
+	ti, err := s.get(`code = ?`, code)
+	if ti != nil {
+		ti.Code = code
+	}
+	return nilTokenInfo(ti, err)
+}
+
+// GetByAccess returns the token info for access, or nil if it's not found.
+func (s *sqliteTokenStore) GetByAccess(access string) (oauth2.TokenInfo, error) {
+	ti, err := s.get(`access = ?`, access)
+	if ti != nil {
+		ti.Access = access
+	}
+	return nilTokenInfo(ti, err)
+}
+
+// GetByRefresh returns the token info for refresh, or nil if it's not found.
+func (s *sqliteTokenStore) GetByRefresh(refresh string) (oauth2.TokenInfo, error) {
+	ti, err := s.get(`refresh = ?`, refresh)
+	if ti != nil {
+		ti.Refresh = refresh
+	}
+	return nilTokenInfo(ti, err)
+}
+
+func (s *sqliteTokenStore) get(where string, token string) (*models.Token, error) {
+	token, err := hash(token)
+	if err != nil {
+		return nil, err
+	}
+	query := `select client_id, user_id, redirect_uri, scope, code_created_at, code_expires_in, access_created_at, access_expires_in, refresh_created_at, refresh_expires_in from oauth2_tokens where ` + where + ` limit 1`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var ti models.Token
+	var codeCreatedAt, accessCreatedAt, refreshCreatedAt string
+	var codeExpiresIn, accessExpiresIn, refreshExpiresIn int64
+	err = stmt.QueryRow(token).Scan(&ti.ClientID, &ti.UserID, &ti.RedirectURI, &ti.Scope, &codeCreatedAt, &codeExpiresIn, &accessCreatedAt, &accessExpiresIn, &refreshCreatedAt, &refreshExpiresIn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ti.CodeCreateAt, err = time.Parse(serializedTimestampFormat, codeCreatedAt); err != nil {
+		return nil, err
+	}
+	if ti.AccessCreateAt, err = time.Parse(serializedTimestampFormat, accessCreatedAt); err != nil {
+		return nil, err
+	}
+	if ti.RefreshCreateAt, err = time.Parse(serializedTimestampFormat, refreshCreatedAt); err != nil {
+		return nil, err
+	}
+	ti.CodeExpiresIn = time.Duration(codeExpiresIn)
+	ti.AccessExpiresIn = time.Duration(accessExpiresIn)
+	ti.RefreshExpiresIn = time.Duration(refreshExpiresIn)
+	return &ti, nil
+}
+
+// nilTokenInfo keeps a nil *models.Token from becoming a non-nil oauth2.TokenInfo.
+func nilTokenInfo(ti *models.Token, err error) (oauth2.TokenInfo, error) {
+	if ti == nil || err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+// hashToken returns the SHA256 checksum of token, or NULL if token is empty so
+// missing codes and tokens never match a lookup.
+func hashToken(token string) (sql.NullString, error) {
+	if token == "" {
+		return sql.NullString{}, nil
+	}
+	h, err := hash(token)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: h, Valid: true}, nil
+}
+
+// listByClient returns the unexpired access and refresh tokens issued to clientId.
+func (s *sqliteTokenStore) listByClient(clientId string) ([]*storedToken, error) {
+	return s.list(`client_id = ?`, clientId)
+}
+
+// listByUser returns the unexpired access and refresh tokens issued for userId.
+func (s *sqliteTokenStore) listByUser(userId string) ([]*storedToken, error) {
+	return s.list(`user_id = ?`, userId)
+}
+
+func (s *sqliteTokenStore) list(where string, arg string) ([]*storedToken, error) {
+	query := `select id, client_id, user_id, scope, access_created_at, valid_until from oauth2_tokens where ` + where + ` and code is null and valid_until >= ? order by access_created_at desc`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(arg, time.Now().Format(serializedTimestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*storedToken
+	for rows.Next() {
+		var t storedToken
+		var createdAt, expiresAt string
+		if err := rows.Scan(&t.ID, &t.ClientID, &t.UserID, &t.Scope, &createdAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if t.CreatedAt, err = time.Parse(serializedTimestampFormat, createdAt); err != nil {
+			return nil, err
+		}
+		if t.ExpiresAt, err = time.Parse(serializedTimestampFormat, expiresAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &t)
+	}
+	return tokens, rows.Err()
+}
+
+// removeByClient deletes every code and token issued to clientId and returns how many
+// were removed.
+func (s *sqliteTokenStore) removeByClient(clientId string) (int64, error) {
+	return s.removeAll(`delete from oauth2_tokens where client_id = ?`, clientId)
+}
+
+// removeByUser deletes every code and token issued for userId and returns how many
+// were removed.
+func (s *sqliteTokenStore) removeByUser(userId string) (int64, error) {
+	return s.removeAll(`delete from oauth2_tokens where user_id = ?`, userId)
+}
+
+func (s *sqliteTokenStore) removeAll(query string, arg string) (int64, error) {
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(arg)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// readTokenOwner reads the client_id or user_id (but not both) query param of the
+// admin token routes.
+func readTokenOwner(r *http.Request) (clientId string, userId string, err error) {
+	clientId, userId = r.URL.Query().Get("client_id"), r.URL.Query().Get("user_id")
+	if (clientId == "") == (userId == "") {
+		return "", "", errors.New("either client_id or user_id is required")
+	}
+	return clientId, userId, nil
+}
+
+// listTokensHandler is an admin endpoint which lists the tokens issued to a client
+// (?client_id=) or for a user (?user_id=).
+func (s *sqliteTokenStore) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	clientId, userId, err := readTokenOwner(r)
+	if err != nil {
+		encodeError(w, err)
+		return
+	}
+	var tokens []*storedToken
+	if clientId != "" {
+		tokens, err = s.listByClient(clientId)
+	} else {
+		tokens, err = s.listByUser(userId)
+	}
+	if err != nil {
+		internalError(w, err, "oauth")
+		return
+	}
+	if tokens == nil {
+		tokens = []*storedToken{}
+	}
+
+	type response struct {
+		Tokens []*storedToken `json:"tokens"`
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(&response{tokens}); err != nil {
+		internalError(w, err, "oauth")
+		return
+	}
+}
+
+// revokeTokensHandler is an admin endpoint which revokes every token issued to a client
+// (?client_id=) or for a user (?user_id=).
+//
+// JWT access tokens can still be verified offline with our public keys until they expire,
+// but introspection and our own checks reject them.
+func (s *sqliteTokenStore) revokeTokensHandler(w http.ResponseWriter, r *http.Request) {
+	clientId, userId, err := readTokenOwner(r)
+	if err != nil {
+		encodeError(w, err)
+		return
+	}
+	var n int64
+	if clientId != "" {
+		n, err = s.removeByClient(clientId)
+	} else {
+		n, err = s.removeByUser(userId)
+	}
+	if err != nil {
+		internalError(w, err, "oauth")
+		return
+	}
+	s.log.Log("oauth", fmt.Sprintf("revoked %d tokens clientId=%s userId=%s", n, clientId, userId))
+	authInactivations.With("method", "oauth2").Add(float64(n))
+	w.WriteHeader(http.StatusOK)
+}
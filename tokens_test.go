@@ -0,0 +1,181 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestTokenStore(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	s := &sqliteTokenStore{db.db, log.NewNopLogger()}
+
+	now := time.Now()
+	if err := s.Create(&models.Token{ClientID: "client", UserID: "user", RedirectURI: "https://moov.io/cb", Code: "code", CodeCreateAt: now, CodeExpiresIn: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	tok := &models.Token{
+		ClientID:         "client",
+		UserID:           "user",
+		Scope:            "read",
+		Access:           "access",
+		AccessCreateAt:   now,
+		AccessExpiresIn:  time.Hour,
+		Refresh:          "refresh",
+		RefreshCreateAt:  now,
+		RefreshExpiresIn: 24 * time.Hour,
+	}
+	if err := s.Create(tok); err != nil {
+		t.Fatal(err)
+	}
+
+	// lookups
+	ti, err := s.GetByCode("code")
+	if err != nil || ti == nil {
+		t.Fatalf("ti=%#v err=%v", ti, err)
+	}
+	if ti.GetCode() != "code" || ti.GetRedirectURI() != "https://moov.io/cb" || ti.GetCodeExpiresIn() != time.Minute {
+		t.Errorf("got %#v", ti)
+	}
+	ti, err = s.GetByAccess("access")
+	if err != nil || ti == nil {
+		t.Fatalf("ti=%#v err=%v", ti, err)
+	}
+	if ti.GetAccess() != "access" || ti.GetClientID() != "client" || ti.GetScope() != "read" || !ti.GetAccessCreateAt().Equal(now) {
+		t.Errorf("got %#v", ti)
+	}
+	if ti, err := s.GetByRefresh("refresh"); err != nil || ti == nil || ti.GetRefresh() != "refresh" || ti.GetRefreshExpiresIn() != 24*time.Hour {
+		t.Errorf("ti=%#v err=%v", ti, err)
+	}
+	for _, token := range []string{"", "other", "access"} {
+		if ti, err := s.GetByRefresh(token); ti != nil || err != nil {
+			t.Errorf("%q: ti=%#v err=%v", token, ti, err)
+		}
+	}
+
+	// tokens aren't stored in plaintext
+	var n int
+	if err := db.db.QueryRow(`select count(*) from oauth2_tokens where code = ? or access = ? or refresh = ?`, "code", "access", "refresh").Scan(&n); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+
+	// removing the access token keeps the refresh token
+	if err := s.RemoveByAccess("access"); err != nil {
+		t.Fatal(err)
+	}
+	if ti, _ := s.GetByAccess("access"); ti != nil {
+		t.Errorf("got %#v", ti)
+	}
+	if ti, _ := s.GetByRefresh("refresh"); ti == nil {
+		t.Error("refresh token removed")
+	}
+	if err := s.RemoveByRefresh("refresh"); err != nil {
+		t.Fatal(err)
+	}
+	if ti, _ := s.GetByRefresh("refresh"); ti != nil {
+		t.Errorf("got %#v", ti)
+	}
+	if err := s.RemoveByCode("code"); err != nil {
+		t.Fatal(err)
+	}
+	if ti, _ := s.GetByCode("code"); ti != nil {
+		t.Errorf("got %#v", ti)
+	}
+
+	// expired tokens are cleaned up
+	expired := &models.Token{ClientID: "client", Access: "expired", AccessCreateAt: now.Add(-2 * time.Hour), AccessExpiresIn: time.Hour}
+	if err := s.Create(expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(&models.Token{ClientID: "client", Access: "new", AccessCreateAt: now, AccessExpiresIn: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if ti, _ := s.GetByAccess("expired"); ti != nil {
+		t.Errorf("got %#v", ti)
+	}
+}
+
+func TestTokenStore__byClientAndUser(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	s := &sqliteTokenStore{db.db, log.NewNopLogger()}
+
+	now := time.Now()
+	create := func(clientId, userId, access string) {
+		t.Helper()
+		err := s.Create(&models.Token{ClientID: clientId, UserID: userId, Access: access, AccessCreateAt: now, AccessExpiresIn: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("first", "alice", "a1")
+	create("first", "bob", "a2")
+	create("second", "alice", "a3")
+	create("second", "", "a4")
+
+	tokens, err := s.listByClient("first")
+	if err != nil || len(tokens) != 2 {
+		t.Fatalf("tokens=%#v err=%v", tokens, err)
+	}
+	if tokens[0].ClientID != "first" || tokens[0].ExpiresAt.Before(now) {
+		t.Errorf("got %#v", tokens[0])
+	}
+	if tokens, err := s.listByUser("alice"); err != nil || len(tokens) != 2 {
+		t.Errorf("tokens=%#v err=%v", tokens, err)
+	}
+
+	if n, err := s.removeByUser("alice"); err != nil || n != 2 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	if ti, _ := s.GetByAccess("a1"); ti != nil {
+		t.Errorf("got %#v", ti)
+	}
+	if n, err := s.removeByClient("second"); err != nil || n != 1 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	if ti, _ := s.GetByAccess("a2"); ti == nil {
+		t.Error("expected a2 to remain")
+	}
+
+	// admin routes
+	w := httptest.NewRecorder()
+	s.listTokensHandler(w, httptest.NewRequest("GET", "/oauth2/tokens?user_id=bob", nil))
+	var resp struct {
+		Tokens []*storedToken `json:"tokens"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(resp.Tokens) != 1 || resp.Tokens[0].ClientID != "first" {
+		t.Errorf("got %d: %#v", w.Code, resp.Tokens)
+	}
+	w = httptest.NewRecorder()
+	s.revokeTokensHandler(w, httptest.NewRequest("DELETE", "/oauth2/tokens?client_id=first&user_id=bob", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.revokeTokensHandler(w, httptest.NewRequest("DELETE", "/oauth2/tokens?client_id=first", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if ti, _ := s.GetByAccess("a2"); ti != nil {
+		t.Errorf("got %#v", ti)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP__rfc6238(t *testing.T) {
+	// Test vectors from RFC 6238 Appendix B (SHA1), truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	cases := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for i := range cases {
+		code, err := totpCode(secret, totpStep(time.Unix(cases[i].unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != cases[i].expected {
+			t.Errorf("T=%d got %s, expected %s", cases[i].unix, code, cases[i].expected)
+		}
+	}
+}
+
+func TestTOTP__validate(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	code, _ := totpCode(secret, totpStep(now)-1)
+	if step, ok := validateTOTP(secret, code, now); !ok || step != totpStep(now)-1 {
+		t.Errorf("expected previous step to be valid, got step=%d ok=%v", step, ok)
+	}
+
+	code, _ = totpCode(secret, totpStep(now)+5)
+	if _, ok := validateTOTP(secret, code, now); ok {
+		t.Error("expected code outside window to be invalid")
+	}
+	if _, ok := validateTOTP(secret, "abc", now); ok {
+		t.Error("expected malformed code to be invalid")
+	}
+}
+
+func TestTOTP__uri(t *testing.T) {
+	uri := totpURI("moov.io", "test@moov.io", "SECRET")
+	if !strings.HasPrefix(uri, "otpauth://totp/moov.io:test@moov.io?") {
+		t.Errorf("got %s", uri)
+	}
+	if !strings.Contains(uri, "secret=SECRET") || !strings.Contains(uri, "issuer=moov.io") {
+		t.Errorf("got %s", uri)
+	}
+}
@@ -20,10 +20,6 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// TODO(adam): validate email (by sending with approval_code) [probably diff file]
-
-// TODO(adam): having a row in user_approval_codes means user isn't verified. Delete on email approval.
-
 type User struct {
 	ID         string    `json:"id"`
 	Email      string    `json:"email"`
@@ -32,6 +28,10 @@ type User struct {
 	Phone      string    `json:"phone"`
 	CompanyURL string    `json:"companyUrl"`
 	CreatedAt  time.Time `json:"createdAt"`
+
+	// Verified is true once the user has clicked through their email approval link.
+	// Having a row in user_approval_codes means the user isn't verified.
+	Verified bool `json:"verified"`
 }
 
 var (
@@ -90,18 +90,33 @@ type userRepository interface {
 	lookupByEmail(email string) (*User, error)
 
 	upsert(*User) error
+
+	// deleteUser removes the user and all their credentials, cookies and approval codes.
+	deleteUser(userId string) error
+
+	// writeApprovalCode saves code for the user, which marks them as unverified
+	// until the code is consumed with consumeApprovalCode.
+	writeApprovalCode(userId string, code string, validUntil time.Time) error
+
+	// consumeApprovalCode finds the user associated with code and deletes the
+	// approval code, marking the user as verified. An empty userId is returned
+	// if the code isn't found or has expired.
+	consumeApprovalCode(code string) (string, error)
 }
 
+// sqliteUserRepository works with every database from openDatabase, not only sqlite.
 type sqliteUserRepository struct {
 	db  *sql.DB
 	log log.Logger
 }
 
 func (s *sqliteUserRepository) lookupByUserId(userId string) (*User, error) {
-	query := `select u.email, u.created_at, ud.first_name, ud.last_name, ud.phone, ud.company_url
+	query := `select u.email, u.created_at, ud.first_name, ud.last_name, ud.phone, ud.company_url, uac.code
 from users as u
 inner join user_details as ud
 on u.user_id = ud.user_id
+left join user_approval_codes as uac
+on u.user_id = uac.user_id
 where u.user_id = ?
 limit 1`
 	stmt, err := s.db.Prepare(query)
@@ -113,7 +128,9 @@ limit 1`
 	u := &User{}
 	u.ID = userId
 	var createdAt string // needs parsing
-	row.Scan(&u.Email, &createdAt, &u.FirstName, &u.LastName, &u.Phone, &u.CompanyURL)
+	var approvalCode sql.NullString
+	row.Scan(&u.Email, &createdAt, &u.FirstName, &u.LastName, &u.Phone, &u.CompanyURL, &approvalCode)
+	u.Verified = !approvalCode.Valid
 	t, err := time.Parse(serializedTimestampFormat, createdAt)
 	if err != nil {
 		s.log.Log("user", fmt.Sprintf("bad users.created_at format %q: %v", createdAt, err))
@@ -146,7 +163,8 @@ func (s *sqliteUserRepository) upsert(inc *User) error {
 	}
 
 	// insert/update into 'users'
-	query := `replace into users (user_id, email, clean_email, created_at) values (?, ?, ?, ?)`
+	query := `insert into users (user_id, email, clean_email, created_at) values (?, ?, ?, ?)
+on conflict (user_id) do update set email = excluded.email, clean_email = excluded.clean_email, created_at = excluded.created_at`
 	stmt, err := tx.Prepare(query)
 	if err != nil {
 		e := tx.Rollback()
@@ -159,7 +177,8 @@ func (s *sqliteUserRepository) upsert(inc *User) error {
 	}
 
 	// insert/update into 'user_details'
-	query = `replace into user_details (user_id, first_name, last_name, phone, company_url) values (?, ?, ?, ?, ?)`
+	query = `insert into user_details (user_id, first_name, last_name, phone, company_url) values (?, ?, ?, ?, ?)
+on conflict (user_id) do update set first_name = excluded.first_name, last_name = excluded.last_name, phone = excluded.phone, company_url = excluded.company_url`
 	stmt, err = tx.Prepare(query)
 	if err != nil {
 		e := tx.Rollback()
@@ -174,18 +193,131 @@ func (s *sqliteUserRepository) upsert(inc *User) error {
 	return tx.Commit()
 }
 
+func (s *sqliteUserRepository) deleteUser(userId string) error {
+	tables := []string{"users", "user_details", "user_approval_codes", "user_sessions", "user_passwords", "user_password_resets", "user_login_links", "user_totp", "user_mfa_challenges", "user_recovery_codes"}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i := range tables {
+		query := fmt.Sprintf(`delete from %s where user_id = ?`, tables[i])
+		if _, err := tx.Exec(query, userId); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem deleting %s userId=%s, err=%v, rollback err=%v", tables[i], userId, err, e)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.log.Log("user", fmt.Sprintf("deleted userId=%s", userId))
+	return nil
+}
+
+func (s *sqliteUserRepository) writeApprovalCode(userId string, code string, validUntil time.Time) error {
+	// the SHA256 checksum is stored, not the actual code.
+	code, err := hash(code)
+	if err != nil {
+		return err
+	}
+
+	query := `insert into user_approval_codes (user_id, code, valid_until) values (?, ?, ?)
+on conflict (user_id) do update set code = excluded.code, valid_until = excluded.valid_until`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId, code, validUntil.Format(serializedTimestampFormat))
+	return err
+}
+
+func (s *sqliteUserRepository) consumeApprovalCode(code string) (string, error) {
+	code, err := hash(code)
+	if err != nil {
+		return "", err
+	}
+
+	query := `select user_id from user_approval_codes where code = ? and valid_until > ?`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	var userId string
+	now := time.Now().Format(serializedTimestampFormat)
+	row := stmt.QueryRow(code, now)
+	if err := row.Scan(&userId); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	// delete by code so only one request can consume it
+	stmt, err = s.db.Prepare(`delete from user_approval_codes where code = ? and valid_until > ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	res, err := stmt.Exec(code, now)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return "", nil
+	}
+	s.log.Log("user", fmt.Sprintf("userId=%s verified email", userId))
+	return userId, nil
+}
+
 // authable represents the interactions of a user's authentication
 // status. This boils down to password comparison and cookie data.
 type authable interface {
 	findUserId(data string) (string, error)
+
+	// invalidateCookies removes every session for the user (i.e. logout everywhere)
 	invalidateCookies(userId string) error
-	writeCookie(userId string, cookie *http.Cookie) error
+
+	// invalidateCookie removes the session associated with cookie data.
+	invalidateCookie(data string) error
+
+	// listSessions returns the active sessions for the user.
+	listSessions(userId string) ([]*session, error)
+
+	// invalidateSession removes a single session of the user by its ID.
+	// false is returned if no session matched.
+	invalidateSession(userId string, sessionId string) (bool, error)
+
+	// writeCookie saves a session for the user along with details
+	// about the client it was issued to.
+	writeCookie(userId string, cookie *http.Cookie, userAgent string, ipAddress string) error
 
 	// checkPassword compares the provided password for the user.
 	// a non-nil error is returned if the passwords don't match
 	// or that the userId doesn't exist.
 	checkPassword(userId string, pass string) error
 	writePassword(userId string, pass string) error
+
+	// writePasswordReset saves a password reset token for the user, replacing
+	// any previous token.
+	writePasswordReset(userId string, token string, validUntil time.Time) error
+
+	// consumePasswordReset finds the user associated with token and deletes
+	// the token so it can't be used again. An empty userId is returned if the
+	// token isn't found or has expired.
+	consumePasswordReset(token string) (string, error)
+
+	// writeLoginLink saves a passwordless login token for the user, replacing
+	// any previous token.
+	writeLoginLink(userId string, token string, validUntil time.Time) error
+
+	// consumeLoginLink finds the user associated with token and deletes the
+	// token so it can't be used again. An empty userId is returned if the token
+	// isn't found or has expired.
+	consumeLoginLink(token string) (string, error)
 }
 
 type auth struct {
@@ -193,7 +325,12 @@ type auth struct {
 	log log.Logger
 }
 
-// findUserId takes cookie data and returns the userId associated
+// lastSeenInterval is how often a session's last_seen timestamp is updated, so
+// every authenticated request doesn't write to the database.
+const lastSeenInterval = time.Minute
+
+// findUserId takes cookie data and returns the userId associated.
+// The session's last_seen timestamp is updated if it's older than lastSeenInterval.
 func (a *auth) findUserId(data string) (string, error) {
 	// the SHA256 checksum is stored, not the actual data.
 	data, err := hash(data)
@@ -201,34 +338,57 @@ func (a *auth) findUserId(data string) (string, error) {
 		return "", err
 	}
 
-	query := `select user_id from user_cookies where data == ? and valid_until > ?`
+	query := `select user_id, last_seen from user_sessions where data = ? and valid_until > ?`
 	stmt, err := a.db.Prepare(query)
 	if err != nil {
 		return "", err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(data, time.Now().Format(serializedTimestampFormat))
+	t := time.Now()
+	now := t.Format(serializedTimestampFormat)
+	rows, err := stmt.Query(data, now)
 	if err != nil {
 		return "", err
 	}
 	defer rows.Close()
 
-	var userId string
+	var userId, lastSeen string
 	for rows.Next() {
-		rows.Scan(&userId)
+		rows.Scan(&userId, &lastSeen)
 		if userId != "" {
-			return userId, nil
+			break
 		}
 	}
-	return "", nil
+	if userId == "" {
+		return "", nil
+	}
+	rows.Close()
+
+	// sessions copied from user_cookies have an empty last_seen, which fails to parse
+	if seen, err := time.Parse(serializedTimestampFormat, lastSeen); err == nil && t.Sub(seen) < lastSeenInterval {
+		return userId, nil
+	}
+
+	stmt, err = a.db.Prepare(`update user_sessions set last_seen = ? where data = ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(now, data); err != nil {
+		return "", err
+	}
+	return userId, nil
 }
 
+// invalidateCookies removes every session for userId (i.e. logout everywhere)
 func (a *auth) invalidateCookies(userId string) error {
-	stmt, err := a.db.Prepare(`delete from user_cookies where user_id = ?`)
+	stmt, err := a.db.Prepare(`delete from user_sessions where user_id = ?`)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
+
 	res, err := stmt.Exec(userId)
 	if err != nil {
 		return err
@@ -238,23 +398,114 @@ func (a *auth) invalidateCookies(userId string) error {
 	return nil
 }
 
-func (a *auth) writeCookie(userId string, cookie *http.Cookie) error {
-	query := `insert or replace into user_cookies (user_id, data, valid_until) values (?, ?, ?)`
+func (a *auth) invalidateCookie(data string) error {
+	data, err := hash(data)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`delete from user_sessions where data = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(data)
+	return err
+}
+
+func (a *auth) listSessions(userId string) ([]*session, error) {
+	query := `select data, created_at, last_seen, user_agent, ip_address from user_sessions where user_id = ? and valid_until > ? order by last_seen desc`
+	stmt, err := a.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userId, time.Now().Format(serializedTimestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*session
+	for rows.Next() {
+		var data, createdAt, lastSeen string
+		var s session
+		if err := rows.Scan(&data, &createdAt, &lastSeen, &s.UserAgent, &s.IPAddress); err != nil {
+			return nil, err
+		}
+		s.ID = sessionID(data)
+		// sessions copied from user_cookies have empty timestamps
+		s.CreatedAt, _ = time.Parse(serializedTimestampFormat, createdAt)
+		s.LastSeen, _ = time.Parse(serializedTimestampFormat, lastSeen)
+		sessions = append(sessions, &s)
+	}
+	return sessions, rows.Err()
+}
+
+func (a *auth) invalidateSession(userId string, sessionId string) (bool, error) {
+	stmt, err := a.db.Prepare(`select data from user_sessions where user_id = ?`)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userId)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	// session ID's aren't stored, so find the matching row
+	var data string
+	for rows.Next() {
+		var d string
+		if err := rows.Scan(&d); err != nil {
+			return false, err
+		}
+		if sessionID(d) == sessionId {
+			data = d
+			break
+		}
+	}
+	rows.Close()
+	if data == "" {
+		return false, nil
+	}
+
+	stmt, err = a.db.Prepare(`delete from user_sessions where user_id = ? and data = ?`)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(userId, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeCookie saves a new session for userId. A user can have multiple sessions at once.
+func (a *auth) writeCookie(userId string, cookie *http.Cookie, userAgent string, ipAddress string) error {
+	query := `insert into user_sessions (data, user_id, created_at, last_seen, user_agent, ip_address, valid_until) values (?, ?, ?, ?, ?, ?, ?)
+on conflict (data) do update set user_id = excluded.user_id, created_at = excluded.created_at, last_seen = excluded.last_seen, user_agent = excluded.user_agent, ip_address = excluded.ip_address, valid_until = excluded.valid_until`
 	stmt, err := a.db.Prepare(query)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
 
 	// hash the data
 	data, err := hash(cookie.Value)
 	if err != nil {
 		return err
 	}
+	now := time.Now().Format(serializedTimestampFormat)
 	validUntil := cookie.Expires.Format(serializedTimestampFormat)
 
 	// write row
-	stmt.Exec(userId, data, validUntil)
-	return nil
+	_, err = stmt.Exec(data, userId, now, now, userAgent, ipAddress, validUntil)
+	return err
 }
 
 // fakeBcryptRounds just performs a bcrypt.GenerateFromPassword and then
@@ -291,7 +542,8 @@ func (a *auth) writePassword(userId string, pass string) error {
 		return err
 	}
 
-	stmt, err := a.db.Prepare(`replace into user_passwords (user_id, password, salt) values (?, ?, ?)`)
+	stmt, err := a.db.Prepare(`insert into user_passwords (user_id, password, salt) values (?, ?, ?)
+on conflict (user_id) do update set password = excluded.password, salt = excluded.salt`)
 	if err != nil {
 		return err
 	}
@@ -303,6 +555,117 @@ func (a *auth) writePassword(userId string, pass string) error {
 	return nil
 }
 
+func (a *auth) writePasswordReset(userId string, token string, validUntil time.Time) error {
+	// the SHA256 checksum is stored, not the actual token.
+	token, err := hash(token)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`insert into user_password_resets (user_id, token, valid_until) values (?, ?, ?)
+on conflict (user_id) do update set token = excluded.token, valid_until = excluded.valid_until`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId, token, validUntil.Format(serializedTimestampFormat))
+	return err
+}
+
+func (a *auth) consumePasswordReset(token string) (string, error) {
+	token, err := hash(token)
+	if err != nil {
+		return "", err
+	}
+
+	stmt, err := a.db.Prepare(`select user_id from user_password_resets where token = ? and valid_until > ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	var userId string
+	now := time.Now().Format(serializedTimestampFormat)
+	row := stmt.QueryRow(token, now)
+	if err := row.Scan(&userId); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	// delete by token so only one request can consume it
+	stmt, err = a.db.Prepare(`delete from user_password_resets where token = ? and valid_until > ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	res, err := stmt.Exec(token, now)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return "", nil
+	}
+	return userId, nil
+}
+
+func (a *auth) writeLoginLink(userId string, token string, validUntil time.Time) error {
+	// the SHA256 checksum is stored, not the actual token.
+	token, err := hash(token)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare(`insert into user_login_links (user_id, token, valid_until) values (?, ?, ?)
+on conflict (user_id) do update set token = excluded.token, valid_until = excluded.valid_until`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId, token, validUntil.Format(serializedTimestampFormat))
+	return err
+}
+
+func (a *auth) consumeLoginLink(token string) (string, error) {
+	token, err := hash(token)
+	if err != nil {
+		return "", err
+	}
+
+	stmt, err := a.db.Prepare(`select user_id from user_login_links where token = ? and valid_until > ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	var userId string
+	row := stmt.QueryRow(token, time.Now().Format(serializedTimestampFormat))
+	if err := row.Scan(&userId); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	// delete by token so only one request can consume it
+	stmt, err = a.db.Prepare(`delete from user_login_links where token = ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	res, err := stmt.Exec(token)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return "", nil
+	}
+	return userId, nil
+}
+
 func hash(in string) (string, error) {
 	ss := sha256.New()
 	n, err := ss.Write([]byte(in))
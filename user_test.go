@@ -5,7 +5,11 @@
 package main
 
 import (
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
 )
 
 func TestUser__cleanEmail(t *testing.T) {
@@ -28,3 +32,88 @@ func TestUser__cleanEmail(t *testing.T) {
 		}
 	}
 }
+
+func TestAuth__multipleSessions(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userId := generateID()
+
+	laptop := httptest.NewRequest("POST", "/users/login", nil)
+	laptop.Header.Set("User-Agent", "laptop")
+	c1, err := createCookie(userId, laptop, authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone := httptest.NewRequest("POST", "/users/login", nil)
+	phone.Header.Set("User-Agent", "phone")
+	c2, err := createCookie(userId, phone, authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both sessions are active
+	for _, c := range []string{c1.Value, c2.Value} {
+		if id, err := authService.findUserId(c); id != userId || err != nil {
+			t.Errorf("got userId=%q, err=%v", id, err)
+		}
+	}
+
+	// logout everywhere
+	if err := authService.invalidateCookies(userId); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{c1.Value, c2.Value} {
+		if id, err := authService.findUserId(c); id != "" || err != nil {
+			t.Errorf("got userId=%q, err=%v", id, err)
+		}
+	}
+}
+
+func TestAuth__findUserIdLastSeen(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	authService := &auth{db.db, log.NewNopLogger()}
+	userId := generateID()
+	c, err := createCookie(userId, httptest.NewRequest("POST", "/users/login", nil), authService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readLastSeen := func() string {
+		t.Helper()
+		var lastSeen string
+		if err := db.db.QueryRow(`select last_seen from user_sessions where user_id = ?`, userId).Scan(&lastSeen); err != nil {
+			t.Fatal(err)
+		}
+		return lastSeen
+	}
+
+	// recently seen sessions aren't written to
+	before := readLastSeen()
+	if id, err := authService.findUserId(c.Value); id != userId || err != nil {
+		t.Fatalf("got userId=%q, err=%v", id, err)
+	}
+	if after := readLastSeen(); after != before {
+		t.Errorf("last_seen updated from %q to %q", before, after)
+	}
+
+	// older sessions are
+	old := time.Now().Add(-2 * lastSeenInterval).Format(serializedTimestampFormat)
+	if _, err := db.db.Exec(`update user_sessions set last_seen = ? where user_id = ?`, old, userId); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := authService.findUserId(c.Value); id != userId || err != nil {
+		t.Fatalf("got userId=%q, err=%v", id, err)
+	}
+	if after := readLastSeen(); after == old {
+		t.Error("last_seen wasn't updated")
+	}
+}
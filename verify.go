@@ -0,0 +1,66 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	approvalCodeTTL = 7 * 24 * time.Hour // days * hours/day
+)
+
+func addVerifyRoutes(router *mux.Router, logger log.Logger, userService userRepository) {
+	router.Methods("GET").Path("/users/verify").HandlerFunc(verifyRoute(logger, userService))
+}
+
+// sendApprovalCode generates a new approval code for u, which marks them as unverified,
+// and emails them a link to verify their email address.
+//
+// Any previous approval code for u is replaced.
+func sendApprovalCode(u *User, userService userRepository, m mailer) error {
+	code := generateID()
+	if code == "" {
+		return errors.New("problem generating approval code")
+	}
+	if err := userService.writeApprovalCode(u.ID, code, time.Now().Add(approvalCodeTTL)); err != nil {
+		return fmt.Errorf("problem writing approval code: %v", err)
+	}
+
+	link := fmt.Sprintf("%s/users/verify?code=%s", BaseURL, url.QueryEscape(code))
+	body := fmt.Sprintf("Please verify your email address by visiting the following link:\n\n%s\n", link)
+	return m.send(u.Email, "Verify your email address", body)
+}
+
+// verifyRoute consumes the approval code sent to a user and marks them as verified.
+func verifyRoute(logger log.Logger, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			encodeError(w, errors.New("missing approval code"))
+			return
+		}
+
+		userId, err := userService.consumeApprovalCode(code)
+		if err != nil {
+			internalError(w, err, "verify")
+			return
+		}
+		if userId == "" {
+			encodeError(w, errors.New("approval code not found or expired"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+	}
+}
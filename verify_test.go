@@ -0,0 +1,103 @@
+// Copyright 2018 The ACH Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// testMailer keeps the last email sent to each address
+type testMailer struct {
+	bodies map[string]string
+}
+
+func (m *testMailer) send(to string, subject string, body string) error {
+	if m.bodies == nil {
+		m.bodies = make(map[string]string)
+	}
+	m.bodies[to] = body
+	return nil
+}
+
+var codeFromLink = regexp.MustCompile(`code=([a-z0-9]+)`)
+
+func TestVerify__approvalCode(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+	u := &User{
+		ID:        generateID(),
+		Email:     "test@moov.io",
+		CreatedAt: time.Now(),
+	}
+	if err := userService.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := userService.lookupByUserId(u.ID); !u.Verified {
+		t.Error("users without an approval code are verified")
+	}
+
+	m := &testMailer{}
+	if err := sendApprovalCode(u, userService, m); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := userService.lookupByUserId(u.ID); u.Verified {
+		t.Error("expected unverified user")
+	}
+	matches := codeFromLink.FindStringSubmatch(m.bodies[u.Email])
+	if len(matches) != 2 {
+		t.Fatalf("no approval code found in %q", m.bodies[u.Email])
+	}
+
+	// verify the user
+	handler := verifyRoute(log.NewNopLogger(), userService)
+	req := httptest.NewRequest("GET", "/users/verify?code="+url.QueryEscape(matches[1]), nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if u, _ := userService.lookupByUserId(u.ID); !u.Verified {
+		t.Error("expected verified user")
+	}
+
+	// codes are single use
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestVerify__expired(t *testing.T) {
+	db, err := createTestSqliteDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	userService := &sqliteUserRepository{db.db, log.NewNopLogger()}
+	if err := userService.writeApprovalCode("userId", "code", time.Now().Add(-1*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	userId, err := userService.consumeApprovalCode("code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId != "" {
+		t.Errorf("expired code returned userId=%s", userId)
+	}
+}